@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for keys that hold nothing.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore holds image bytes. Keys are the names the Redis backend has
+// always used (image:<id>, image:<id>:v:<variant>, ...); metadata such as
+// content types, sizes and the variant set stays in Redis whatever the
+// backend.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, ctype string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// blobStreamer is implemented by backends that can store a blob straight
+// from a reader, so uploads need not be held in memory. sum is the hex
+// SHA-256 of the size bytes r yields.
+type blobStreamer interface {
+	PutStream(ctx context.Context, key string, r io.Reader, size int64, sum, ctype string) error
+}
+
+// BlobConfig selects and configures a BlobStore. The same variables are
+// passed on to image-job so both sides read and write the same place.
+type BlobConfig struct {
+	Backend     string // redis | fs | s3
+	Dir         string // fs: directory, typically a PVC mount
+	PVC         string // fs: claim to mount into image-job pods
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool // bucket in the path rather than the host name, as MinIO expects
+}
+
+func blobConfigFromEnv() BlobConfig {
+	return BlobConfig{
+		Backend:     strings.ToLower(getenv("BLOB_STORE", "redis")),
+		Dir:         getenv("BLOB_DIR", "/data/images"),
+		PVC:         getenv("BLOB_PVC", ""),
+		S3Endpoint:  getenv("S3_ENDPOINT", ""),
+		S3Bucket:    getenv("S3_BUCKET", ""),
+		S3Region:    getenv("S3_REGION", "us-east-1"),
+		S3AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey: os.Getenv("S3_SECRET_KEY"),
+		S3PathStyle: getenvBool("S3_PATH_STYLE", true),
+	}
+}
+
+// NewBlobStore builds the backend named by cfg.Backend.
+func NewBlobStore(cfg BlobConfig, rdb *RedisClient) (BlobStore, error) {
+	switch cfg.Backend {
+	case "", "redis":
+		return redisBlobStore{rdb}, nil
+	case "fs":
+		return newFSBlobStore(cfg.Dir)
+	case "s3":
+		return newS3BlobStore(cfg)
+	}
+	return nil, fmt.Errorf("unknown BLOB_STORE %q (want redis, fs or s3)", cfg.Backend)
+}
+
+// redisBlobStore keeps bytes in Redis string values.
+type redisBlobStore struct{ rdb *RedisClient }
+
+func (s redisBlobStore) Put(ctx context.Context, key string, data []byte, _ string) error {
+	return s.rdb.Set(ctx, key, data, 0)
+}
+
+func (s redisBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := s.rdb.GetBytes(ctx, key)
+	if errors.Is(err, ErrNil) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s redisBlobStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := s.rdb.Del(ctx, keys...)
+	return err
+}
+
+// fsBlobStore keeps one file per key in a flat directory.
+type fsBlobStore struct{ dir string }
+
+func newFSBlobStore(dir string) (*fsBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("blob dir: %w", err)
+	}
+	return &fsBlobStore{dir: dir}, nil
+}
+
+func (s *fsBlobStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *fsBlobStore) Put(_ context.Context, key string, data []byte, _ string) error {
+	return s.write(key, bytes.NewReader(data))
+}
+
+func (s *fsBlobStore) PutStream(_ context.Context, key string, r io.Reader, _ int64, _, _ string) error {
+	return s.write(key, r)
+}
+
+// write copies r to a temporary file and renames it over the target, so
+// readers never see a partial image.
+func (s *fsBlobStore) write(key string, r io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *fsBlobStore) Get(_ context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s *fsBlobStore) Delete(_ context.Context, keys ...string) error {
+	for _, k := range keys {
+		p, err := s.path(k)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	maxPipelineOps = 8
+	maxImageSide   = 8192
+)
+
+// effectOp is one step of an effect pipeline. The image-job applies the
+// steps in order, each to the output of the previous one.
+type effectOp struct {
+	Op     string         `json:"op"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+type paramKind int
+
+const (
+	paramNumber paramKind = iota
+	paramInt
+	paramString
+	paramBool
+)
+
+// paramSpec describes one accepted parameter of an effect.
+type paramSpec struct {
+	kind     paramKind
+	min, max float64  // inclusive bounds for numbers; ignored when both are zero
+	enum     []string // allowed values for strings; any when empty
+	required bool
+}
+
+// effectDef lists the params an effect accepts and an optional check run
+// after the individual params have been validated.
+type effectDef struct {
+	params map[string]paramSpec
+	check  func(p map[string]any) error
+}
+
+var resizeFilters = []string{"nearest", "bilinear", "catmullrom", "lanczos"}
+
+// effectCatalog lists every effect the image-job understands and the
+// parameters each accepts. Keep in sync with app/image-job/effects.go.
+var effectCatalog = map[string]effectDef{
+	"grayscale": {},
+	"invert":    {},
+	"resize": {
+		params: map[string]paramSpec{
+			"width":  {kind: paramInt, min: 1, max: maxImageSide},
+			"height": {kind: paramInt, min: 1, max: maxImageSide},
+			"mode":   {kind: paramString, enum: []string{"fit", "fill", "stretch"}},
+			"filter": {kind: paramString, enum: resizeFilters},
+		},
+		check: func(p map[string]any) error {
+			_, w := p["width"]
+			_, h := p["height"]
+			if !w && !h {
+				return fmt.Errorf("width or height required")
+			}
+			if m, _ := p["mode"].(string); m != "" && m != "fit" && (!w || !h) {
+				return fmt.Errorf("mode %s needs both width and height", m)
+			}
+			return nil
+		},
+	},
+	"crop": {
+		params: map[string]paramSpec{
+			"x":      {kind: paramInt, min: 0, max: maxImageSide},
+			"y":      {kind: paramInt, min: 0, max: maxImageSide},
+			"width":  {kind: paramInt, min: 1, max: maxImageSide, required: true},
+			"height": {kind: paramInt, min: 1, max: maxImageSide, required: true},
+		},
+	},
+	"rotate": {
+		params: map[string]paramSpec{
+			"angle": {kind: paramNumber, min: -360, max: 360, required: true},
+		},
+	},
+	"flip": {
+		params: map[string]paramSpec{
+			"direction": {kind: paramString, enum: []string{"horizontal", "vertical"}},
+		},
+	},
+	"blur": {
+		params: map[string]paramSpec{
+			"radius": {kind: paramInt, min: 1, max: 50},
+			"sigma":  {kind: paramNumber, min: 0.1, max: 25},
+		},
+	},
+	"sharpen": {
+		params: map[string]paramSpec{
+			"radius":    {kind: paramInt, min: 1, max: 50},
+			"sigma":     {kind: paramNumber, min: 0.1, max: 25},
+			"amount":    {kind: paramNumber, min: 0, max: 10},
+			"threshold": {kind: paramNumber, min: 0, max: 255},
+		},
+	},
+	"edge": {},
+	"emboss": {
+		params: map[string]paramSpec{
+			"strength": {kind: paramNumber, min: 0, max: 10},
+		},
+	},
+	"brightness": {
+		params: map[string]paramSpec{
+			"amount": {kind: paramNumber, min: -1, max: 1, required: true},
+		},
+	},
+	"contrast": {
+		params: map[string]paramSpec{
+			"amount": {kind: paramNumber, min: -1, max: 1, required: true},
+		},
+	},
+	"gamma": {
+		params: map[string]paramSpec{
+			"value": {kind: paramNumber, min: 0.1, max: 10, required: true},
+		},
+	},
+	"saturation": {
+		params: map[string]paramSpec{
+			"amount": {kind: paramNumber, min: -1, max: 1, required: true},
+		},
+	},
+	"hue": {
+		params: map[string]paramSpec{
+			"degrees": {kind: paramNumber, min: -180, max: 180, required: true},
+		},
+	},
+	"sepia": {
+		params: map[string]paramSpec{
+			"amount": {kind: paramNumber, min: 0, max: 1},
+		},
+	},
+	"threshold": {
+		params: map[string]paramSpec{
+			"level": {kind: paramNumber, min: 0, max: 255},
+		},
+	},
+	"posterize": {
+		params: map[string]paramSpec{
+			"levels": {kind: paramInt, min: 2, max: 64},
+		},
+	},
+}
+
+func effectNames() []string {
+	names := make([]string, 0, len(effectCatalog))
+	for n := range effectCatalog {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// normalizeOp lower-cases the op name and checks it and its params against
+// the catalog. Integer params are rewritten as whole numbers.
+func normalizeOp(op *effectOp) error {
+	op.Op = strings.ToLower(strings.TrimSpace(op.Op))
+	def, ok := effectCatalog[op.Op]
+	if !ok {
+		return fmt.Errorf("unknown effect %q (supported: %s)", op.Op, strings.Join(effectNames(), ", "))
+	}
+	for name := range op.Params {
+		if _, ok := def.params[name]; !ok {
+			return fmt.Errorf("%s: unknown param %q", op.Op, name)
+		}
+	}
+	for name, spec := range def.params {
+		v, ok := op.Params[name]
+		if !ok {
+			if spec.required {
+				return fmt.Errorf("%s: param %q required", op.Op, name)
+			}
+			continue
+		}
+		nv, err := spec.check(v)
+		if err != nil {
+			return fmt.Errorf("%s: param %q: %w", op.Op, name, err)
+		}
+		op.Params[name] = nv
+	}
+	if def.check != nil {
+		if err := def.check(op.Params); err != nil {
+			return fmt.Errorf("%s: %w", op.Op, err)
+		}
+	}
+	return nil
+}
+
+func (s paramSpec) check(v any) (any, error) {
+	switch s.kind {
+	case paramNumber, paramInt:
+		f, ok := v.(float64)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("must be a number")
+		}
+		if s.kind == paramInt {
+			if f != math.Trunc(f) {
+				return nil, fmt.Errorf("must be an integer")
+			}
+		}
+		if (s.min != 0 || s.max != 0) && (f < s.min || f > s.max) {
+			return nil, fmt.Errorf("must be between %g and %g", s.min, s.max)
+		}
+		if s.kind == paramInt {
+			return int64(f), nil
+		}
+		return f, nil
+	case paramString:
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		str = strings.ToLower(strings.TrimSpace(str))
+		if len(s.enum) > 0 {
+			for _, e := range s.enum {
+				if str == e {
+					return str, nil
+				}
+			}
+			return nil, fmt.Errorf("must be one of %s", strings.Join(s.enum, ", "))
+		}
+		return str, nil
+	case paramBool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be a boolean")
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unsupported param kind")
+}
+
+// pipelineVariant derives a variant name from the op names, e.g.
+// "resize+grayscale". Long or parameterised pipelines get a stable hash so
+// that different parameters do not overwrite each other's output.
+func pipelineVariant(ops []effectOp, spec []byte) string {
+	names := make([]string, len(ops))
+	params := false
+	for i, op := range ops {
+		names[i] = op.Op
+		params = params || len(op.Params) > 0
+	}
+	name := strings.Join(names, "+")
+	if !params && variantRe.MatchString(name) {
+		return name
+	}
+	sum := sha1.Sum(spec)
+	hashed := name + "-" + hex.EncodeToString(sum[:4])
+	if variantRe.MatchString(hashed) {
+		return hashed
+	}
+	return "fx-" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// Upload metadata policy, set from UPLOAD_STRIP_METADATA and
+// UPLOAD_AUTO_ORIENT at startup.
+var (
+	stripMetadata = true
+	autoOrient    = false
+)
+
+// autoOrientQuality is the JPEG quality used when auto-orienting forces a
+// re-encode. The source quality is unknown, so err on the high side.
+const autoOrientQuality = 92
+
+const (
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+)
+
+// sensitiveTags identify the device or its owner. They are removed along
+// with the whole GPS IFD when stripping. MakerNote is opaque vendor data
+// that routinely carries serial numbers.
+var sensitiveTags = map[uint16]string{
+	0x927C: "MakerNote",
+	0xA420: "ImageUniqueID",
+	0xA430: "CameraOwnerName",
+	0xA431: "BodySerialNumber",
+	0xA435: "LensSerialNumber",
+	0xC62F: "CameraSerialNumber",
+}
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// uploadMeta reports what prepareUpload did, for logging.
+type uploadMeta struct {
+	Orientation int
+	Oriented    bool
+	Stripped    []string
+}
+
+// prepareUpload applies the metadata policy to an uploaded JPEG: it strips
+// GPS and device identifiers and, when enabled, rotates the pixels to match
+// the EXIF orientation. Only the segments before the image data are read
+// into memory; when they change, the result is a new spooled upload that
+// the caller must close. Other formats are returned unchanged.
+func prepareUpload(sp *spooledUpload) (*spooledUpload, uploadMeta, error) {
+	var meta uploadMeta
+	if sp.format.name != "jpeg" {
+		return sp, meta, nil
+	}
+	hdr, err := readJPEGHeader(sp.Reader())
+	if err != nil {
+		return nil, meta, err
+	}
+	out, meta, err := rewriteJPEGMeta(hdr, stripMetadata)
+	if err != nil {
+		return nil, meta, err
+	}
+	scan := io.NewSectionReader(sp.f, int64(len(hdr)), sp.size-int64(len(hdr)))
+	if autoOrient && meta.Orientation > 1 {
+		// Rotating means decoding, which needs the whole file anyway.
+		data, err := io.ReadAll(io.MultiReader(bytes.NewReader(out), scan))
+		if err != nil {
+			return nil, meta, err
+		}
+		if data, err = orientJPEG(data, meta.Orientation); err != nil {
+			return nil, meta, err
+		}
+		meta.Oriented = true
+		rs, err := respool(bytes.NewReader(data))
+		return rs, meta, err
+	}
+	if bytes.Equal(out, hdr) {
+		return sp, meta, nil
+	}
+	rs, err := respool(bytes.NewReader(out), scan)
+	return rs, meta, err
+}
+
+// maxJPEGHeader bounds the segments read ahead of the image data. Each
+// segment is at most 64 KiB, and real files carry a handful.
+const maxJPEGHeader = 4 << 20
+
+// readJPEGHeader returns the bytes of a JPEG up to, not including, the
+// start of scan marker.
+func readJPEGHeader(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 2, 64<<10)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	for len(hdr) < maxJPEGHeader {
+		m, err := br.Peek(2)
+		if err != nil {
+			return nil, errors.New("jpeg: truncated header")
+		}
+		if m[0] != 0xFF {
+			return nil, errors.New("jpeg: bad marker")
+		}
+		if m[1] == 0xFF { // fill byte
+			br.Discard(1)
+			hdr = append(hdr, 0xFF)
+			continue
+		}
+		if m[1] == 0xDA || m[1] == 0xD9 {
+			return hdr, nil
+		}
+		seg, err := br.Peek(4)
+		if err != nil {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		n := int(binary.BigEndian.Uint16(seg[2:]))
+		if n < 2 {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		hdr = append(hdr, make([]byte, 2+n)...)
+		if _, err := io.ReadFull(br, hdr[len(hdr)-2-n:]); err != nil {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+	}
+	return nil, errors.New("jpeg: header too large")
+}
+
+// rewriteJPEGMeta copies the JPEG, reading the EXIF orientation on the way.
+// With strip set, sensitive EXIF tags are removed and XMP packets, which
+// duplicate them, are dropped. An EXIF block too broken to edit safely is
+// dropped entirely.
+func rewriteJPEGMeta(data []byte, strip bool) ([]byte, uploadMeta, error) {
+	var meta uploadMeta
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, meta, errors.New("jpeg: bad marker")
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		// Everything from the start of scan on is image data.
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil, meta, errors.New("jpeg: truncated segment")
+		}
+		seg := data[i : i+2+n]
+		payload := seg[4:]
+		i += 2 + n
+
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			tiff := append([]byte(nil), payload[len(exifHeader):]...)
+			orient, stripped, err := editTIFF(tiff, strip)
+			if err != nil {
+				if strip {
+					meta.Stripped = append(meta.Stripped, "Exif")
+					continue
+				}
+				out = append(out, seg...)
+				continue
+			}
+			meta.Orientation = orient
+			meta.Stripped = append(meta.Stripped, stripped...)
+			out = append(out, seg[:4]...)
+			out = append(out, exifHeader...)
+			out = append(out, tiff...)
+			continue
+		}
+		if strip && marker == 0xE1 && bytes.HasPrefix(payload, xmpHeader) {
+			meta.Stripped = append(meta.Stripped, "XMP")
+			continue
+		}
+		out = append(out, seg...)
+	}
+	return append(out, data[i:]...), meta, nil
+}
+
+// tiffBlock is a TIFF structure as embedded in an EXIF segment. Offsets
+// are relative to the start of b.
+type tiffBlock struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+// typeSizes gives the byte size of each TIFF field type.
+var typeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+func (t *tiffBlock) u16(off int) uint16 { return t.bo.Uint16(t.b[off:]) }
+func (t *tiffBlock) u32(off int) uint32 { return t.bo.Uint32(t.b[off:]) }
+
+// ifd validates the IFD at off and returns its entry count.
+func (t *tiffBlock) ifd(off int) (int, error) {
+	if off < 8 || off+2 > len(t.b) {
+		return 0, fmt.Errorf("exif: ifd offset %d out of range", off)
+	}
+	n := int(t.u16(off))
+	if off+2+12*n+4 > len(t.b) {
+		return 0, fmt.Errorf("exif: ifd at %d truncated", off)
+	}
+	return n, nil
+}
+
+// valueSpan returns where the value of the entry at e lives and how long it
+// is. Values of four bytes or fewer are stored inline in the entry.
+func (t *tiffBlock) valueSpan(e int) (int, int, bool) {
+	typ := int(t.u16(e + 2))
+	if typ <= 0 || typ >= len(typeSizes) {
+		return 0, 0, false
+	}
+	size := int64(typeSizes[typ]) * int64(t.u32(e+4))
+	if size <= 4 {
+		return e + 8, int(size), true
+	}
+	off := int64(t.u32(e + 8))
+	if off+size > int64(len(t.b)) {
+		return 0, 0, false
+	}
+	return int(off), int(size), true
+}
+
+// wipe zeroes the value of the entry at e so the bytes do not linger in
+// the file after the entry itself is removed.
+func (t *tiffBlock) wipe(e int) {
+	if off, n, ok := t.valueSpan(e); ok {
+		clear(t.b[off : off+n])
+	}
+}
+
+// removeEntry deletes entry k of the IFD at off, shifting the remaining
+// entries and the next-IFD pointer down.
+func (t *tiffBlock) removeEntry(off, k int) {
+	n := int(t.u16(off))
+	start := off + 2 + 12*k
+	end := off + 2 + 12*n + 4
+	copy(t.b[start:], t.b[start+12:end])
+	clear(t.b[end-12 : end])
+	t.bo.PutUint16(t.b[off:], uint16(n-1))
+}
+
+// editTIFF reads the orientation from IFD0 and, with strip set, removes
+// sensitive tags from IFD0, the Exif sub-IFD and the GPS IFD in place. It
+// returns the orientation (0 if absent) and the names of removed tags.
+func editTIFF(b []byte, strip bool) (int, []string, error) {
+	if len(b) < 8 {
+		return 0, nil, errors.New("exif: short tiff header")
+	}
+	t := &tiffBlock{b: b}
+	switch string(b[:4]) {
+	case "II*\x00":
+		t.bo = binary.LittleEndian
+	case "MM\x00*":
+		t.bo = binary.BigEndian
+	default:
+		return 0, nil, errors.New("exif: bad tiff header")
+	}
+	ifd0 := int(t.u32(4))
+	n, err := t.ifd(ifd0)
+	if err != nil {
+		return 0, nil, err
+	}
+	orient := 0
+	for k := 0; k < n; k++ {
+		e := ifd0 + 2 + 12*k
+		if t.u16(e) == tagOrientation && t.u16(e+2) == 3 {
+			orient = int(t.u16(e + 8))
+		}
+	}
+	if !strip {
+		return orient, nil, nil
+	}
+	var stripped []string
+	if err := t.strip(ifd0, 0, &stripped); err != nil {
+		return 0, nil, err
+	}
+	return orient, stripped, nil
+}
+
+// strip removes sensitive entries from the IFD at off, descending into the
+// Exif sub-IFD and wiping the GPS IFD wholesale.
+func (t *tiffBlock) strip(off, depth int, stripped *[]string) error {
+	if depth > 2 {
+		return errors.New("exif: ifd nesting too deep")
+	}
+	n, err := t.ifd(off)
+	if err != nil {
+		return err
+	}
+	// Walk backwards so removals do not shift entries still to be visited.
+	for k := n - 1; k >= 0; k-- {
+		e := off + 2 + 12*k
+		tag := t.u16(e)
+		switch {
+		case tag == tagExifIFD:
+			if err := t.strip(int(t.u32(e+8)), depth+1, stripped); err != nil {
+				return err
+			}
+		case tag == tagGPSIFD:
+			if err := t.wipeIFD(int(t.u32(e + 8))); err != nil {
+				return err
+			}
+			t.removeEntry(off, k)
+			*stripped = append(*stripped, "GPS")
+		case sensitiveTags[tag] != "":
+			t.wipe(e)
+			t.removeEntry(off, k)
+			*stripped = append(*stripped, sensitiveTags[tag])
+		}
+	}
+	return nil
+}
+
+// wipeIFD zeroes the IFD at off together with all values it points to.
+func (t *tiffBlock) wipeIFD(off int) error {
+	n, err := t.ifd(off)
+	if err != nil {
+		return err
+	}
+	for k := 0; k < n; k++ {
+		t.wipe(off + 2 + 12*k)
+	}
+	clear(t.b[off : off+2+12*n+4])
+	return nil
+}
+
+// orientJPEG rotates and flips the pixels of a JPEG to undo EXIF
+// orientation o, then re-encodes it. The (already sanitised) EXIF block is
+// carried over with its orientation reset to 1 so viewers do not rotate
+// the image a second time.
+func orientJPEG(data []byte, o int) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("auto-orient decode: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orientImage(img, o), &jpeg.Options{Quality: autoOrientQuality}); err != nil {
+		return nil, fmt.Errorf("auto-orient encode: %w", err)
+	}
+	enc := buf.Bytes()
+	app1 := exifSegment(data)
+	if app1 == nil {
+		return enc, nil
+	}
+	setOrientation(app1[4+len(exifHeader):], 1)
+	out := make([]byte, 0, len(enc)+len(app1))
+	out = append(out, enc[:2]...)
+	out = append(out, app1...)
+	return append(out, enc[2:]...), nil
+}
+
+// exifSegment returns a copy of the first APP1 EXIF segment of a JPEG,
+// marker included, or nil.
+func exifSegment(data []byte) []byte {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			break
+		}
+		if marker == 0xE1 && bytes.HasPrefix(data[i+4:i+2+n], exifHeader) {
+			return append([]byte(nil), data[i:i+2+n]...)
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// setOrientation overwrites the IFD0 orientation value in place.
+func setOrientation(b []byte, o int) {
+	t := &tiffBlock{b: b, bo: binary.BigEndian}
+	if len(b) < 8 {
+		return
+	}
+	if string(b[:2]) == "II" {
+		t.bo = binary.LittleEndian
+	}
+	ifd0 := int(t.u32(4))
+	n, err := t.ifd(ifd0)
+	if err != nil {
+		return
+	}
+	for k := 0; k < n; k++ {
+		e := ifd0 + 2 + 12*k
+		if t.u16(e) == tagOrientation && t.u16(e+2) == 3 {
+			t.bo.PutUint16(b[e+8:], uint16(o))
+		}
+	}
+}
+
+// orientImage returns img transformed so that it displays upright given
+// EXIF orientation o (1-8). Orientations 5-8 swap width and height.
+func orientImage(img image.Image, o int) *image.NRGBA {
+	src := toNRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch o {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// A post holds an ordered gallery of images. Every image has its own ID,
+// and all image:* keys are keyed by it, so effects, variants and
+// thumbnails work per image. Posts from before galleries have a single
+// image whose ID is the post ID; they read as a one-image gallery until
+// the gallery is first changed.
+
+// galleryKey lists the image IDs of a post in display order.
+func galleryKey(postID string) string { return "post:images:" + postID }
+
+// imageOwnerKey holds the ID of the post an image belongs to.
+func imageOwnerKey(imageID string) string { return "image:post:" + imageID }
+
+// errNotInGallery is returned for image IDs that do not belong to the post.
+var errNotInGallery = errors.New("image not in gallery")
+
+// errBadOrder rejects a reorder that does not list the gallery exactly.
+var errBadOrder = errors.New("order does not match gallery")
+
+// galleryIDs returns the image IDs of a post in order, including a legacy
+// single image.
+func galleryIDs(ctx context.Context, postID string) ([]string, error) {
+	gs, err := galleries(ctx, []string{postID})
+	if err != nil {
+		return nil, err
+	}
+	return gs[0], nil
+}
+
+// galleries looks up the galleries of several posts in one round trip.
+func galleries(ctx context.Context, postIDs []string) ([][]string, error) {
+	pipe := rdb.Pipeline()
+	for _, id := range postIDs {
+		pipe.Do("LRANGE", galleryKey(id), "0", "-1")
+		pipe.Do("EXISTS", variantCtypeKey(id, ""))
+	}
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]string, len(postIDs))
+	for i, id := range postIDs {
+		items, _ := replies[2*i].([]any)
+		for _, it := range items {
+			if b, ok := it.([]byte); ok {
+				out[i] = append(out[i], string(b))
+			}
+		}
+		if legacy, _ := replies[2*i+1].(int64); len(out[i]) == 0 && legacy > 0 {
+			out[i] = []string{id}
+		}
+	}
+	return out, nil
+}
+
+// gallery is the gallery of a post as read inside a watched transaction.
+// Legacy is set when the only image is a legacy one keyed by the post ID,
+// with no gallery list stored yet.
+type gallery struct {
+	PostID string
+	IDs    []string
+	Legacy bool
+}
+
+// migrate returns the commands that store a legacy single image as a real
+// gallery entry, so it can be reordered or deleted like any other. They go
+// ahead of any other write to the gallery.
+func (g gallery) migrate() [][]any {
+	if !g.Legacy {
+		return nil
+	}
+	return [][]any{
+		{"RPUSH", galleryKey(g.PostID), g.PostID},
+		{"SET", imageOwnerKey(g.PostID), g.PostID},
+	}
+}
+
+// readGallery reads the gallery of postID through tx, returning
+// errPostNotFound if the post is gone.
+func readGallery(tx *Tx, postID string) (gallery, error) {
+	g := gallery{PostID: postID}
+	if n, err := tx.Do("EXISTS", "post:"+postID); err != nil {
+		return g, err
+	} else if n != int64(1) {
+		return g, errPostNotFound
+	}
+	v, err := tx.Do("LRANGE", galleryKey(postID), "0", "-1")
+	if err != nil {
+		return g, err
+	}
+	items, _ := v.([]any)
+	for _, it := range items {
+		if b, ok := it.([]byte); ok {
+			g.IDs = append(g.IDs, string(b))
+		}
+	}
+	if len(g.IDs) == 0 {
+		n, err := tx.Do("EXISTS", variantCtypeKey(postID, ""))
+		if err != nil {
+			return g, err
+		}
+		if n == int64(1) {
+			g.IDs, g.Legacy = []string{postID}, true
+		}
+	}
+	return g, nil
+}
+
+// watchGallery runs a transaction that watches the post and its gallery:
+// fn gets the gallery as it stands and returns the commands to run, which
+// only go through if neither changed meanwhile. It is retried a few times
+// when it loses a race.
+func watchGallery(ctx context.Context, postID string, fn func(tx *Tx, g gallery) ([][]any, error)) ([]any, error) {
+	keys := []string{"post:" + postID, galleryKey(postID), variantCtypeKey(postID, "")}
+	return watchRetry(ctx, keys, func(tx *Tx) ([][]any, error) {
+		g, err := readGallery(tx, postID)
+		if err != nil {
+			return nil, err
+		}
+		return fn(tx, g)
+	})
+}
+
+// imageOwner returns the post an image belongs to, or "" if none does.
+func imageOwner(ctx context.Context, imageID string) (string, error) {
+	owner, err := rdb.GetString(ctx, imageOwnerKey(imageID))
+	if err == nil {
+		return owner, nil
+	}
+	if !errors.Is(err, ErrNil) {
+		return "", err
+	}
+	// A legacy image shares its post's ID; so does the target of a legacy
+	// POST /images/{post id} upload.
+	n, err := rdb.Exists(ctx, "post:"+imageID)
+	if err != nil || n == 0 {
+		return "", err
+	}
+	return imageID, nil
+}
+
+// newImageID returns an unused image ID. Legacy images use post IDs, so
+// those are avoided too.
+func newImageID(ctx context.Context) (string, error) {
+	for range 5 {
+		id, err := randomID(12)
+		if err != nil {
+			return "", err
+		}
+		pipe := rdb.Pipeline()
+		pipe.Do("EXISTS", "post:"+id, variantCtypeKey(id, ""), imageOwnerKey(id))
+		replies, err := pipe.Exec(ctx)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := replies[0].(int64); n == 0 {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("could not generate unique image id")
+}
+
+// addGalleryImage appends a stored image to the gallery of a post. An
+// image already in the gallery keeps its place. errPostNotFound means the
+// post was deleted, possibly while the image was being stored.
+func addGalleryImage(ctx context.Context, postID, imageID string) error {
+	_, err := watchGallery(ctx, postID, func(tx *Tx, g gallery) ([][]any, error) {
+		if slices.Contains(g.IDs, imageID) {
+			return nil, nil
+		}
+		return append(g.migrate(),
+			[]any{"RPUSH", galleryKey(postID), imageID},
+			[]any{"SET", imageOwnerKey(imageID), postID},
+		), nil
+	})
+	return err
+}
+
+// writeAddImageError answers a failed addGalleryImage. When the post is
+// gone the stored image belongs to nothing, so it is deleted.
+func writeAddImageError(ctx context.Context, w http.ResponseWriter, imageID string, err error) {
+	if !errors.Is(err, errPostNotFound) {
+		httpError(w, http.StatusInternalServerError, "save failed")
+		return
+	}
+	if derr := discardImage(ctx, imageID); derr != nil {
+		log.Printf("[gallery] discard image=%s: %v", imageID, derr)
+	}
+	httpError(w, http.StatusNotFound, "post not found")
+}
+
+// discardImage deletes an image that was stored but never added to a
+// gallery.
+func discardImage(ctx context.Context, imageID string) error {
+	del, deleteBlobs, err := deleteImage(ctx, imageID)
+	if err != nil {
+		return err
+	}
+	if _, err := rdb.Multi(ctx, del); err != nil {
+		return err
+	}
+	return deleteBlobs()
+}
+
+// removeGalleryImage deletes one image of a post with all its variants,
+// and the post's choice of cover if it was that image.
+func removeGalleryImage(ctx context.Context, postID, imageID string) error {
+	var deleteBlobs func() error
+	_, err := watchGallery(ctx, postID, func(tx *Tx, g gallery) ([][]any, error) {
+		if !slices.Contains(g.IDs, imageID) {
+			return nil, errNotInGallery
+		}
+		delImage, del, err := deleteImage(ctx, imageID)
+		if err != nil {
+			return nil, err
+		}
+		deleteBlobs = del
+		cmds := append(g.migrate(),
+			[]any{"LREM", galleryKey(postID), "0", imageID},
+			[]any{"DEL", imageOwnerKey(imageID)},
+			delImage,
+		)
+		cover, err := tx.Do("HGET", "post:"+postID, "cover")
+		if err != nil {
+			return nil, err
+		}
+		if toString(cover) == imageID {
+			cmds = append(cmds, []any{"HDEL", "post:" + postID, "cover"})
+		}
+		return cmds, nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteBlobs()
+}
+
+// deleteGallery returns the commands and blob deleter that remove the
+// images ids of a post and its gallery, like deleteImage does for one.
+func deleteGallery(ctx context.Context, postID string, ids []string) ([]any, func() error, error) {
+	del := []any{"DEL", galleryKey(postID)}
+	var deleters []func() error
+	for _, id := range ids {
+		cmd, deleteBlobs, err := deleteImage(ctx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		del = append(del, cmd[1:]...)
+		del = append(del, imageOwnerKey(id))
+		deleters = append(deleters, deleteBlobs)
+	}
+	return del, func() error {
+		var errs []error
+		for _, d := range deleters {
+			errs = append(errs, d())
+		}
+		return errors.Join(errs...)
+	}, nil
+}
+
+// coverOf picks the cover of a gallery: the chosen one while it is still
+// in the gallery, else the first image.
+func coverOf(ids []string, chosen string) string {
+	if chosen != "" && slices.Contains(ids, chosen) {
+		return chosen
+	}
+	if len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// attachImages fills in the cover image of each post and, with full set,
+// the whole gallery.
+func attachImages(ctx context.Context, posts []Post, full bool) error {
+	ids := make([]string, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+	}
+	gs, err := galleries(ctx, ids)
+	if err != nil {
+		return err
+	}
+	var want []string
+	for i := range posts {
+		posts[i].Cover = coverOf(gs[i], posts[i].Cover)
+		if full {
+			want = append(want, gs[i]...)
+		} else if posts[i].Cover != "" {
+			want = append(want, posts[i].Cover)
+		}
+	}
+	infos, err := imageInfos(ctx, want)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Image = infos[posts[i].Cover]
+		if full {
+			posts[i].Images = make([]*postImage, 0, len(gs[i]))
+			for _, id := range gs[i] {
+				posts[i].Images = append(posts[i].Images, infos[id])
+			}
+		}
+	}
+	return nil
+}
+
+// effectTarget resolves the image an effect job should process: imageID
+// if it belongs to the post, or the post's cover when imageID is empty.
+// It returns "" when there is no such image.
+func effectTarget(ctx context.Context, postID, imageID string) (string, error) {
+	m, err := rdb.HGetAll(ctx, "post:"+postID)
+	if err != nil || len(m) == 0 {
+		return "", err
+	}
+	ids, err := galleryIDs(ctx, postID)
+	if err != nil {
+		return "", err
+	}
+	if imageID == "" {
+		return coverOf(ids, m["cover"]), nil
+	}
+	if !slices.Contains(ids, imageID) {
+		return "", nil
+	}
+	return imageID, nil
+}
+
+// galleryResp is the body returned by the gallery endpoints.
+type galleryResp struct {
+	PostID string       `json:"post_id"`
+	Cover  string       `json:"cover,omitempty"`
+	Images []*postImage `json:"images"`
+}
+
+func writeGallery(w http.ResponseWriter, r *http.Request, postID string, code int) {
+	m, err := rdb.HGetAll(r.Context(), "post:"+postID)
+	if err != nil || len(m) == 0 {
+		httpError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	posts := []Post{postFromHash(postID, m)}
+	if err := attachImages(r.Context(), posts, true); err != nil {
+		httpError(w, http.StatusInternalServerError, "gallery lookup failed")
+		return
+	}
+	writeJSON(w, code, galleryResp{PostID: postID, Cover: posts[0].Cover, Images: posts[0].Images})
+}
+
+// postImagesHandler serves /posts/{id}/images[/{image id}] and
+// /posts/{id}/cover.
+func postImagesHandler(w http.ResponseWriter, r *http.Request, postID, sub string) {
+	imageID, hasImage := strings.CutPrefix(sub, "images/")
+	switch {
+	case sub == "images" && r.Method == http.MethodGet:
+		writeGallery(w, r, postID, http.StatusOK)
+	case sub == "images" && r.Method == http.MethodPost:
+		if err := handleAddGalleryImage(w, r, postID); err != nil {
+			log.Printf("[gallery] upload post=%s error: %v", postID, err)
+		}
+	case sub == "images" && r.Method == http.MethodPut:
+		handleReorderGallery(w, r, postID)
+	case hasImage && idRe.MatchString(imageID) && r.Method == http.MethodDelete:
+		handleDeleteGalleryImage(w, r, postID, imageID)
+	case sub == "cover" && r.Method == http.MethodPut:
+		handleSetCover(w, r, postID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleAddGalleryImage(w http.ResponseWriter, r *http.Request, postID string) error {
+	ctx := r.Context()
+	if n, err := rdb.Exists(ctx, "post:"+postID); err != nil || n == 0 {
+		httpError(w, http.StatusNotFound, "post not found")
+		return err
+	}
+	release, ok := acquireUploadSlot(w)
+	if !ok {
+		return errUploadsBusy
+	}
+	defer release()
+	sp, name, err := readUpload(w, r)
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+	imageID, err := newImageID(ctx)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "id generation failed")
+		return err
+	}
+	n, ctype, err := ingestImage(ctx, w, imageID, sp)
+	if err != nil {
+		return err
+	}
+	if err := addGalleryImage(ctx, postID, imageID); err != nil {
+		writeAddImageError(ctx, w, imageID, err)
+		return err
+	}
+	log.Printf("[gallery] added post=%s image=%s name=%q bytes=%d ctype=%s", postID, imageID, name, n, ctype)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":      imageID,
+		"post_id": postID,
+		"url":     imageURL(imageID),
+		"bytes":   n,
+	})
+	return nil
+}
+
+type reorderReq struct {
+	Order []string `json:"order"`
+}
+
+func handleReorderGallery(w http.ResponseWriter, r *http.Request, postID string) {
+	ctx := r.Context()
+	var req reorderReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	_, err := watchGallery(ctx, postID, func(tx *Tx, g gallery) ([][]any, error) {
+		a, b := slices.Clone(g.IDs), slices.Clone(req.Order)
+		slices.Sort(a)
+		slices.Sort(b)
+		if !slices.Equal(a, b) {
+			return nil, errBadOrder
+		}
+		if len(g.IDs) == 0 {
+			return nil, nil
+		}
+		push := []any{"RPUSH", galleryKey(postID)}
+		for _, id := range req.Order {
+			push = append(push, id)
+		}
+		return append(g.migrate(), []any{"DEL", galleryKey(postID)}, push), nil
+	})
+	switch {
+	case errors.Is(err, errPostNotFound):
+		httpError(w, http.StatusNotFound, "post not found")
+		return
+	case errors.Is(err, errBadOrder):
+		httpError(w, http.StatusBadRequest, "order must list every image of the post exactly once")
+		return
+	case errors.Is(err, ErrTxAborted):
+		httpError(w, http.StatusConflict, "gallery changed during reorder, retry")
+		return
+	case err != nil:
+		httpError(w, http.StatusInternalServerError, "reorder failed")
+		return
+	}
+	log.Printf("[gallery] reordered post=%s order=%v", postID, req.Order)
+	writeGallery(w, r, postID, http.StatusOK)
+}
+
+func handleDeleteGalleryImage(w http.ResponseWriter, r *http.Request, postID, imageID string) {
+	err := removeGalleryImage(r.Context(), postID, imageID)
+	if errors.Is(err, errNotInGallery) || errors.Is(err, errPostNotFound) {
+		httpError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	if errors.Is(err, ErrTxAborted) {
+		httpError(w, http.StatusConflict, "gallery changed during delete, retry")
+		return
+	}
+	if err != nil {
+		log.Printf("[gallery] delete post=%s image=%s error: %v", postID, imageID, err)
+		httpError(w, http.StatusInternalServerError, "delete failed")
+		return
+	}
+	log.Printf("[gallery] deleted post=%s image=%s", postID, imageID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type coverReq struct {
+	ImageID string `json:"image_id"`
+}
+
+func handleSetCover(w http.ResponseWriter, r *http.Request, postID string) {
+	ctx := r.Context()
+	var req coverReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	// The gallery is checked inside the transaction, so the cover cannot be
+	// set on a post, or to an image, deleted meanwhile.
+	_, err := updatePost(ctx, postID, map[string]string{"cover": req.ImageID},
+		[]string{galleryKey(postID), variantCtypeKey(postID, "")}, func(tx *Tx) error {
+			g, err := readGallery(tx, postID)
+			if err == nil && !slices.Contains(g.IDs, req.ImageID) {
+				err = errNotInGallery
+			}
+			return err
+		})
+	switch {
+	case errors.Is(err, errPostNotFound):
+		httpError(w, http.StatusNotFound, "post not found")
+		return
+	case errors.Is(err, errNotInGallery):
+		httpError(w, http.StatusNotFound, "image not found")
+		return
+	case err != nil:
+		httpError(w, http.StatusInternalServerError, "hset failed")
+		return
+	}
+	log.Printf("[gallery] cover post=%s image=%s", postID, req.ImageID)
+	writeGallery(w, r, postID, http.StatusOK)
+}
+
+// imageURL is the path an image is served at.
+func imageURL(imageID string) string {
+	return "/images/" + url.PathEscape(imageID)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// originalVariant names the uploaded image; every other variant is the
+// output of an effect job and lives under its own key.
+const originalVariant = "original"
+
+var variantRe = regexp.MustCompile(`^[a-z0-9][a-z0-9+_-]{0,63}$`)
+
+func variantKey(id, variant string) string {
+	if variant == "" || variant == originalVariant {
+		return "image:" + id
+	}
+	return "image:" + id + ":v:" + variant
+}
+
+func variantCtypeKey(id, variant string) string {
+	if variant == "" || variant == originalVariant {
+		return "image:ctype:" + id
+	}
+	return "image:ctype:" + id + ":v:" + variant
+}
+
+func variantsKey(id string) string { return "image:variants:" + id }
+func activeFxKey(id string) string { return "image:fx:" + id }
+
+// imageKeys lists the keys of the image of post id: blobs holds the bytes
+// of every variant and thumbnail in blobStore, meta the Redis keys that
+// describe them.
+func imageKeys(ctx context.Context, id string) (blobs, meta []string, err error) {
+	names, err := rdb.SMembers(ctx, variantsKey(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	variants := append([]string{originalVariant}, names...)
+	pipe := rdb.Pipeline()
+	for _, v := range variants {
+		pipe.Do("HKEYS", sizesKey(id, v))
+	}
+	widths, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta = []string{activeFxKey(id), variantsKey(id)}
+	for i, v := range variants {
+		blobs = append(blobs, variantKey(id, v))
+		meta = append(meta, variantCtypeKey(id, v), blobInfoKey(variantKey(id, v)), sizesKey(id, v))
+		// The widest entry is the variant itself, not a thumbnail.
+		ws, _ := widths[i].([]any)
+		var ns []int
+		for _, w := range ws {
+			b, _ := w.([]byte)
+			if n, err := strconv.Atoi(string(b)); err == nil {
+				ns = append(ns, n)
+			}
+		}
+		sort.Ints(ns)
+		for _, n := range ns[:max(0, len(ns)-1)] {
+			blobs = append(blobs, thumbKey(id, v, n))
+			meta = append(meta, thumbCtypeKey(id, v, n), blobInfoKey(thumbKey(id, v, n)))
+		}
+	}
+	return blobs, meta, nil
+}
+
+// saveImage stores an upload as the new original together with its
+// thumbnails, dropping variants derived from any previous upload. sizes
+// may be nil when the upload could not be decoded.
+func saveImage(ctx context.Context, id string, body *spooledUpload, ctype string, sizes *renditions) error {
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	staleBlobs, staleMeta, err := imageKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+	// Bytes are written before the metadata that refers to them, so a
+	// reader never finds a content type or size without its blob.
+	written := map[string]bool{variantKey(id, ""): true}
+	if err := putSpooled(ctx, variantKey(id, ""), body, ctype); err != nil {
+		return err
+	}
+	del := []any{"DEL"}
+	for _, k := range staleMeta {
+		del = append(del, k)
+	}
+	cmds := [][]any{del,
+		{"SET", variantCtypeKey(id, ""), ctype},
+		blobInfo{ETag: sumETag(body.sum), Modified: time.Now()}.hset(variantKey(id, "")),
+	}
+	if sizes != nil {
+		hset := []any{"HSET", sizesKey(id, ""), strconv.Itoa(sizes.Width), strconv.Itoa(sizes.Height)}
+		for _, t := range sizes.Thumbs {
+			key := thumbKey(id, "", t.Width)
+			if err := blobStore.Put(ctx, key, t.Data, t.Ctype); err != nil {
+				return err
+			}
+			written[key] = true
+			hset = append(hset, strconv.Itoa(t.Width), strconv.Itoa(t.Height))
+			cmds = append(cmds,
+				[]any{"SET", thumbCtypeKey(id, "", t.Width), t.Ctype},
+				newBlobInfo(t.Data).hset(key),
+			)
+		}
+		cmds = append(cmds, hset)
+	}
+	if _, err := rdb.Multi(ctx, cmds...); err != nil {
+		return err
+	}
+	var orphans []string
+	for _, k := range staleBlobs {
+		if !written[k] {
+			orphans = append(orphans, k)
+		}
+	}
+	return blobStore.Delete(ctx, orphans...)
+}
+
+// deleteImage removes every blob and metadata key of the image of post id.
+// The metadata commands are returned rather than run so callers can fold
+// them into a larger MULTI; the blobs are deleted by the returned func,
+// which should run once that has succeeded.
+func deleteImage(ctx context.Context, id string) ([]any, func() error, error) {
+	blobs, meta, err := imageKeys(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	del := []any{"DEL"}
+	for _, k := range meta {
+		del = append(del, k)
+	}
+	return del, func() error { return blobStore.Delete(ctx, blobs...) }, nil
+}
+
+// loadImage returns the requested variant. An empty variant selects the
+// active one (the last applied effect), falling back to the original. A
+// positive width selects the narrowest thumbnail at least that wide.
+func loadImage(ctx context.Context, id, variant string, width int) (*storedImage, error) {
+	if variant == "" {
+		active, err := rdb.GetString(ctx, activeFxKey(id))
+		if err != nil && !errors.Is(err, ErrNil) {
+			return nil, err
+		}
+		if active != "" {
+			if img, err := loadVariant(ctx, id, active, width); err == nil {
+				return img, nil
+			}
+		}
+		variant = originalVariant
+	}
+	return loadVariant(ctx, id, variant, width)
+}
+
+func loadVariant(ctx context.Context, id, variant string, width int) (*storedImage, error) {
+	if width > 0 {
+		sizes, err := rdb.HGetAll(ctx, sizesKey(id, variant))
+		if err != nil {
+			return nil, err
+		}
+		if w := pickWidth(sizes, width); w > 0 {
+			if img, err := loadBlob(ctx, thumbKey(id, variant, w), thumbCtypeKey(id, variant, w)); err == nil {
+				return img, nil
+			}
+		}
+	}
+	return loadBlob(ctx, variantKey(id, variant), variantCtypeKey(id, variant))
+}
+
+// storedImage is a blob looked up for serving, with its validators. The
+// data is only fetched from the blob store by load, so a conditional
+// request can be answered from the validators alone.
+type storedImage struct {
+	key   string
+	data  []byte
+	ctype string
+	info  blobInfo
+}
+
+func loadBlob(ctx context.Context, key, ctypeKey string) (*storedImage, error) {
+	pipe := rdb.Pipeline()
+	pipe.Do("GET", ctypeKey)
+	pipe.Do("HGETALL", blobInfoKey(key))
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctype, ok := replies[0].([]byte)
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	img := &storedImage{key: key, ctype: string(ctype)}
+	if img.ctype == "" {
+		img.ctype = "application/octet-stream"
+	}
+	m, _ := parseHash(replies[1])
+	if img.info, ok = parseBlobInfo(m); !ok {
+		// Stored before validators were recorded: hash now, and leave the
+		// modification time unknown.
+		if err := img.load(ctx); err != nil {
+			return nil, err
+		}
+		img.info = blobInfo{ETag: contentETag(img.data)}
+	}
+	return img, nil
+}
+
+// load fetches the image data from the blob store, once.
+func (img *storedImage) load(ctx context.Context) error {
+	if img.data != nil {
+		return nil
+	}
+	data, err := blobStore.Get(ctx, img.key)
+	if err != nil {
+		return err
+	}
+	img.data = data
+	return nil
+}
+
+// blobInfoKey holds the ETag and modification time of the blob at key.
+func blobInfoKey(key string) string {
+	return "image:info:" + strings.TrimPrefix(key, "image:")
+}
+
+// blobInfo holds the validators served with a blob. ETag is a hash of the
+// content, so it is strong: equal tags mean byte-identical images.
+type blobInfo struct {
+	ETag     string
+	Modified time.Time
+}
+
+func newBlobInfo(data []byte) blobInfo {
+	return blobInfo{ETag: contentETag(data), Modified: time.Now()}
+}
+
+func contentETag(data []byte) string {
+	h := sha256.Sum256(data)
+	return sumETag(h[:])
+}
+
+// sumETag makes an ETag from the SHA-256 of a blob.
+func sumETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// hset returns the command storing bi for the blob at key.
+func (bi blobInfo) hset(key string) []any {
+	return []any{"HSET", blobInfoKey(key), "etag", bi.ETag, "modified", strconv.FormatInt(bi.Modified.Unix(), 10)}
+}
+
+func parseBlobInfo(m map[string]string) (blobInfo, bool) {
+	sec, err := strconv.ParseInt(m["modified"], 10, 64)
+	if m["etag"] == "" || err != nil {
+		return blobInfo{}, false
+	}
+	return blobInfo{ETag: m["etag"], Modified: time.Unix(sec, 0)}, true
+}
+
+// notModified reports whether r is a conditional GET that bi satisfies,
+// following the precedence of http.ServeContent: If-None-Match, when sent,
+// decides alone; otherwise If-Modified-Since is compared at one second
+// resolution.
+func (bi blobInfo) notModified(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(bi.ETag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || bi.Modified.IsZero() {
+		return false
+	}
+	return !bi.Modified.Truncate(time.Second).After(ims)
+}
+
+// listVariants returns the active variant and all stored ones, original first.
+func listVariants(ctx context.Context, id string) (string, []string, error) {
+	pipe := rdb.Pipeline()
+	pipe.Do("EXISTS", variantCtypeKey(id, ""))
+	pipe.Do("GET", activeFxKey(id))
+	pipe.Do("SMEMBERS", variantsKey(id))
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if n, _ := replies[0].(int64); n == 0 {
+		return "", nil, ErrNil
+	}
+	names := []string{originalVariant}
+	members, _ := replies[2].([]any)
+	for _, m := range members {
+		if b, ok := m.([]byte); ok {
+			names = append(names, string(b))
+		}
+	}
+	active := originalVariant
+	if b, ok := replies[1].([]byte); ok && len(b) > 0 {
+		active = string(b)
+	}
+	return active, names, nil
+}
+
+// revertImage makes the original the active variant again. Stored variants
+// are kept so they can still be fetched explicitly.
+func revertImage(ctx context.Context, id string) error {
+	n, err := rdb.Exists(ctx, variantCtypeKey(id, ""))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNil
+	}
+	_, err = rdb.Del(ctx, activeFxKey(id))
+	return err
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cancelledJobTTL is how long a cancelled Job keeps reporting "cancelled"
+// after it has been deleted from the cluster.
+const cancelledJobTTL = 24 * time.Hour
+
+func cancelledJobKey(name string) string { return "job:cancelled:" + name }
+
+// jobNameRe matches the names CreateImageEffectJob generates: DNS-1123
+// labels of at most 63 characters. Names go into API server paths, so
+// anything else is refused before it gets there.
+var jobNameRe = regexp.MustCompile(`^imgfx-[a-z0-9]([-a-z0-9]{0,55}[a-z0-9])?$`)
+
+// jobHandler serves /jobs/{name} (DELETE cancels), /jobs/{name}/status and
+// /jobs/{name}/logs.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if k8s == nil {
+		httpError(w, http.StatusServiceUnavailable, "kubernetes not available in this environment")
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	name, sub, _ := strings.Cut(p, "/")
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !jobNameRe.MatchString(name) {
+		httpError(w, http.StatusBadRequest, "invalid job name")
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodDelete:
+		handleCancelJob(w, r, name)
+	case sub == "status" && r.Method == http.MethodGet:
+		handleJobStatus(w, r, name)
+	case sub == "logs" && r.Method == http.MethodGet:
+		handleJobLogs(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleJobStatus(w http.ResponseWriter, r *http.Request, name string) {
+	st, err := currentJobState(r.Context(), name)
+	if errors.Is(err, errJobNotFound) {
+		httpError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "status error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": st.Status,
+		"reason": st.Reason,
+		"name":   name,
+	})
+}
+
+// currentJobState is k8s.JobState, except that a Job deleted by a cancellation
+// still reports "cancelled" for cancelledJobTTL.
+func currentJobState(ctx context.Context, name string) (jobState, error) {
+	st, err := k8s.JobState(ctx, name)
+	if !errors.Is(err, errJobNotFound) {
+		return st, err
+	}
+	n, rerr := rdb.Exists(ctx, cancelledJobKey(name))
+	if rerr != nil {
+		return jobState{}, rerr
+	}
+	if n == 0 {
+		return jobState{}, errJobNotFound
+	}
+	return jobState{Status: "cancelled"}, nil
+}
+
+func handleCancelJob(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+	err := k8s.CancelJob(ctx, name)
+	switch {
+	case errors.Is(err, errJobNotFound):
+		httpError(w, http.StatusNotFound, "job not found")
+		return
+	case errors.Is(err, errJobNotOurs):
+		httpError(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, errJobFinished):
+		httpError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("[k8s] cancel job %s: %v", name, err)
+		httpError(w, http.StatusInternalServerError, "failed to cancel job")
+		return
+	}
+	if err := rdb.Set(ctx, cancelledJobKey(name), []byte("1"), int(cancelledJobTTL.Seconds())); err != nil {
+		log.Printf("[redis] record cancelled job %s: %v", name, err)
+	}
+	log.Printf("[k8s] job %s cancelled", name)
+	writeJSON(w, http.StatusOK, map[string]any{"name": name, "status": "cancelled"})
+}
+
+// jobSummary describes an effect Job in job listings.
+type jobSummary struct {
+	Name      string          `json:"name"`
+	PostID    string          `json:"post_id,omitempty"`
+	ImageID   string          `json:"image_id,omitempty"`
+	Effect    string          `json:"effect,omitempty"`
+	Pipeline  json.RawMessage `json:"pipeline,omitempty"`
+	Status    string          `json:"status"`
+	Reason    string          `json:"reason,omitempty"`
+	Created   *time.Time      `json:"created_at,omitempty"`
+	Started   *time.Time      `json:"started_at,omitempty"`
+	Completed *time.Time      `json:"completed_at,omitempty"`
+}
+
+func summarizeJob(doc *jobObject) jobSummary {
+	st := doc.state()
+	js := jobSummary{
+		Name:    doc.Metadata.Name,
+		PostID:  doc.Metadata.Labels["post-id"],
+		ImageID: doc.Metadata.Labels["image-id"],
+		Effect:  doc.Metadata.Annotations["variant"],
+		Status:  st.Status,
+		Reason:  st.Reason,
+		Created: doc.Metadata.CreationTimestamp,
+		Started: doc.Status.StartTime,
+	}
+	if p := doc.Metadata.Annotations["pipeline"]; json.Valid([]byte(p)) {
+		js.Pipeline = json.RawMessage(p)
+	}
+	if st.Status == "succeeded" || st.Status == "failed" {
+		js.Completed = doc.finishedAt()
+	}
+	return js
+}
+
+var jobStatuses = map[string]bool{"pending": true, "running": true, "succeeded": true, "failed": true, "cancelled": true}
+
+// jobsListHandler serves GET /jobs, optionally filtered with ?status=.
+func jobsListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if k8s == nil {
+		httpError(w, http.StatusServiceUnavailable, "kubernetes not available in this environment")
+		return
+	}
+	writeJobList(w, r, "")
+}
+
+// handlePostJobs serves GET /posts/{id}/jobs: the effect Jobs run on any
+// image of the post, optionally filtered with ?status=.
+func handlePostJobs(w http.ResponseWriter, r *http.Request, postID string) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if k8s == nil {
+		httpError(w, http.StatusServiceUnavailable, "kubernetes not available in this environment")
+		return
+	}
+	if n, err := rdb.Exists(r.Context(), "post:"+postID); err != nil || n == 0 {
+		httpError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	writeJobList(w, r, "post-id="+postID)
+}
+
+// writeJobList answers with the Jobs matching selector, newest first.
+func writeJobList(w http.ResponseWriter, r *http.Request, selector string) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !jobStatuses[status] {
+		httpError(w, http.StatusBadRequest, "status must be one of pending, running, succeeded, failed, cancelled")
+		return
+	}
+	docs, err := k8s.ListJobs(r.Context(), selector)
+	if err != nil {
+		log.Printf("[k8s] list jobs (%s): %v", selector, err)
+		httpError(w, http.StatusInternalServerError, "failed to list jobs")
+		return
+	}
+	out := make([]jobSummary, 0, len(docs))
+	for i := range docs {
+		js := summarizeJob(&docs[i])
+		if status == "" || js.Status == status {
+			out = append(out, js)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i].Created, out[j].Created
+		if a == nil || b == nil {
+			return a != nil
+		}
+		if !a.Equal(*b) {
+			return a.After(*b)
+		}
+		return out[i].Name < out[j].Name
+	})
+	writeJSON(w, http.StatusOK, out)
+}
+
+// maxLogTail caps the tail query parameter of /jobs/{name}/logs.
+const maxLogTail = 10000
+
+// handleJobLogs streams the log of the Job's pod as plain text. ?follow=true
+// keeps the response open while the container runs; ?tail=N returns only
+// the last N lines.
+func handleJobLogs(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+	follow := false
+	if v := q.Get("follow"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "follow must be true or false")
+			return
+		}
+		follow = b
+	}
+	tail := 0
+	if v := q.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			httpError(w, http.StatusBadRequest, "tail must be a positive number of lines")
+			return
+		}
+		tail = min(n, maxLogTail)
+	}
+	logs, err := k8s.JobLogs(r.Context(), name, follow, tail)
+	switch {
+	case errors.Is(err, errJobNotFound):
+		httpError(w, http.StatusNotFound, "job not found")
+		return
+	case errors.Is(err, errJobNotOurs):
+		httpError(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, errNoJobPod), errors.Is(err, errPodNotStarted):
+		httpError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("[k8s] logs of job %s: %v", name, err)
+		httpError(w, http.StatusBadGateway, "failed to read job logs")
+		return
+	}
+	defer logs.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	var dst io.Writer = w
+	if follow {
+		dst = flushWriter{w: w, rc: http.NewResponseController(w)}
+	}
+	if _, err := io.Copy(dst, logs); err != nil && r.Context().Err() == nil {
+		log.Printf("[k8s] logs of job %s: %v", name, err)
+	}
+}
+
+// flushWriter flushes after every write, so followed log lines reach the
+// client as they arrive.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		err = fw.rc.Flush()
+	}
+	return n, err
+}
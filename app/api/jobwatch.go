@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// imageJobSelector matches the Jobs created from the effect job template.
+const imageJobSelector = "app=image-effect"
+
+// jobWatchTimeout asks the API server to end each watch after this long; the
+// watch is then resumed from the last resourceVersion seen.
+const jobWatchTimeout = 5 * time.Minute
+
+// errWatchExpired means the resourceVersion being watched from is older than
+// the API server keeps (410 Gone), so the Jobs must be listed again.
+var errWatchExpired = errors.New("resourceVersion expired")
+
+// jobState is the status reported for a Job.
+type jobState struct {
+	Status string
+	Reason string
+}
+
+// jobCache holds the status of every image-effect Job as reported by the
+// watch, so status polls are answered without a request to the API server.
+// It is only trusted while synced: between a failed watch and the next
+// successful one it may have missed changes.
+type jobCache struct {
+	mu     sync.RWMutex
+	jobs   map[string]jobState
+	synced bool
+}
+
+func newJobCache() *jobCache {
+	return &jobCache{jobs: map[string]jobState{}}
+}
+
+// lookup reports the cached status of a Job, if the cache is synced and
+// knows it.
+func (c *jobCache) lookup(name string) (jobState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	st, ok := c.jobs[name]
+	return st, ok && c.synced
+}
+
+// add records a Job the watch has not reported yet, leaving any status it
+// already has alone.
+func (c *jobCache) add(name string, st jobState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.jobs[name]; !ok {
+		c.jobs[name] = st
+	}
+}
+
+func (c *jobCache) set(name string, st jobState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs[name] = st
+}
+
+func (c *jobCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.jobs, name)
+}
+
+// replace swaps in the result of a fresh list.
+func (c *jobCache) replace(jobs map[string]jobState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs = jobs
+}
+
+func (c *jobCache) setSynced(synced bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.synced = synced
+}
+
+// WatchJobs keeps kc.jobs current until ctx is done. It lists the
+// image-effect Jobs once, then watches from the list's resourceVersion,
+// resuming after each watch ends and listing again when the API server
+// answers 410 Gone. Failures are retried with backoff.
+func (kc *K8sClient) WatchJobs(ctx context.Context) {
+	const maxBackoff = 30 * time.Second
+	backoff := time.Second
+	rv := ""
+	for ctx.Err() == nil {
+		var err error
+		if rv == "" {
+			if rv, err = kc.listJobs(ctx); err == nil {
+				log.Printf("[k8s] job watch: listed jobs at resourceVersion %s", rv)
+			}
+		}
+		from := rv
+		if err == nil {
+			rv, err = kc.watchJobsFrom(ctx, rv)
+			if rv != from {
+				backoff = time.Second
+			}
+		}
+		switch {
+		case err == nil:
+			// The server ended the watch; resume where it left off, after
+			// a pause if nothing came through, so a server that keeps
+			// closing the stream straight away is not hammered.
+			if rv == from {
+				sleepCtx(ctx, time.Second)
+			}
+		case errors.Is(err, errWatchExpired):
+			log.Printf("[k8s] job watch: %v, relisting", err)
+			rv = ""
+		case ctx.Err() != nil:
+			return
+		default:
+			kc.jobs.setSynced(false)
+			log.Printf("[k8s] job watch: %v (retrying in %s)", err, backoff)
+			sleepCtx(ctx, backoff)
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}
+}
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+func (kc *K8sClient) jobsPath(q url.Values) string {
+	q.Set("labelSelector", imageJobSelector)
+	return "/apis/batch/v1/namespaces/" + kc.namespace + "/jobs?" + q.Encode()
+}
+
+// listJobs fills the cache with every image-effect Job and returns the
+// resourceVersion to watch from.
+func (kc *K8sClient) listJobs(ctx context.Context) (string, error) {
+	resp, err := kc.do(ctx, http.MethodGet, kc.jobsPath(url.Values{}), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("list jobs http %d: %s", resp.StatusCode, string(b))
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []jobObject `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("decode job list: %w", err)
+	}
+	jobs := make(map[string]jobState, len(list.Items))
+	for i := range list.Items {
+		jobs[list.Items[i].Metadata.Name] = list.Items[i].state()
+	}
+	kc.jobs.replace(jobs)
+	kc.jobs.setSynced(true)
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watchEvent is one line of a watch stream. For ERROR events the object is
+// a metav1.Status rather than a Job.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watchJobsFrom applies watch events after resourceVersion rv to the cache
+// until the stream ends, returning the last resourceVersion seen.
+func (kc *K8sClient) watchJobsFrom(ctx context.Context, rv string) (string, error) {
+	q := url.Values{}
+	q.Set("watch", "1")
+	q.Set("allowWatchBookmarks", "true")
+	q.Set("resourceVersion", rv)
+	q.Set("timeoutSeconds", fmt.Sprint(int(jobWatchTimeout.Seconds())))
+	resp, err := kc.send(ctx, http.MethodGet, kc.jobsPath(q), "", nil, true)
+	if err != nil {
+		return rv, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return rv, errWatchExpired
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return rv, fmt.Errorf("watch jobs http %d: %s", resp.StatusCode, string(b))
+	}
+	// The server replays every change after rv before anything else, so
+	// the cache is as good as synced once the watch is accepted.
+	kc.jobs.setSynced(true)
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				return rv, nil
+			}
+			return rv, fmt.Errorf("read watch: %w", err)
+		}
+		if ev.Type == "ERROR" {
+			var st struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(ev.Object, &st)
+			if st.Code == http.StatusGone {
+				return rv, errWatchExpired
+			}
+			return rv, fmt.Errorf("watch error %d: %s", st.Code, st.Message)
+		}
+		var job jobObject
+		if err := json.Unmarshal(ev.Object, &job); err != nil {
+			return rv, fmt.Errorf("decode %s event: %w", ev.Type, err)
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			kc.jobs.set(job.Metadata.Name, job.state())
+		case "DELETED":
+			kc.jobs.remove(job.Metadata.Name)
+		case "BOOKMARK":
+			// Carries only a newer resourceVersion to resume from.
+		}
+		if job.Metadata.ResourceVersion != "" {
+			rv = job.Metadata.ResourceVersion
+		}
+	}
+}
+
+// JobState returns the status of a Job, from the watch cache when it can.
+func (kc *K8sClient) JobState(ctx context.Context, name string) (jobState, error) {
+	if st, ok := kc.jobs.lookup(name); ok {
+		return st, nil
+	}
+	status, reason, err := kc.JobStatus(ctx, name)
+	return jobState{Status: status, Reason: reason}, err
+}
@@ -6,19 +6,41 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	saTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	saCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
 type K8sClient struct {
 	baseURL   string
-	token     string
 	namespace string
-	httpc     *http.Client
+	jobs      *jobCache
+
+	// tokenFile and caFile, when set, are re-read by reloadCredentials so
+	// rotated service account tokens and CA bundles are picked up.
+	tokenFile string
+	caFile    string
+	tlsConfig *tls.Config // RootCAs is replaced when caFile changes
+
+	mu     sync.RWMutex
+	token  string
+	caPEM  []byte
+	httpc  *http.Client
+	watchc *http.Client // no overall timeout, for long-running watches
 }
 
 func NewInClusterK8sClient() (*K8sClient, error) {
@@ -27,7 +49,7 @@ func NewInClusterK8sClient() (*K8sClient, error) {
 	if host == "" || port == "" {
 		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST/PORT not set")
 	}
-	token, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
+	token, err := os.ReadFile(saTokenPath)
 	if err != nil {
 		return nil, fmt.Errorf("read token: %w", err)
 	}
@@ -35,7 +57,7 @@ func NewInClusterK8sClient() (*K8sClient, error) {
 	if err != nil {
 		return nil, fmt.Errorf("read namespace: %w", err)
 	}
-	ca, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+	ca, err := os.ReadFile(saCAPath)
 	if err != nil {
 		return nil, fmt.Errorf("read ca.crt: %w", err)
 	}
@@ -43,63 +65,172 @@ func NewInClusterK8sClient() (*K8sClient, error) {
 	if ok := pool.AppendCertsFromPEM(ca); !ok {
 		return nil, fmt.Errorf("append ca cert failed")
 	}
-	tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
-	httpc := &http.Client{Transport: tr, Timeout: 10 * time.Second}
-	return &K8sClient{
-		baseURL:   "https://" + host + ":" + port,
-		token:     strings.TrimSpace(string(token)),
-		namespace: strings.TrimSpace(string(ns)),
-		httpc:     httpc,
-	}, nil
+	kc := newK8sClient("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(ns)),
+		strings.TrimSpace(string(token)), &tls.Config{RootCAs: pool})
+	kc.tokenFile, kc.caFile, kc.caPEM = saTokenPath, saCAPath, ca
+	return kc, nil
 }
 
-func (kc *K8sClient) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+// NewK8sClient connects from inside the cluster when running in a pod, and
+// otherwise through the kubeconfig a developer would use with kubectl.
+func NewK8sClient() (*K8sClient, string, error) {
+	kc, err := NewInClusterK8sClient()
+	if err == nil {
+		return kc, "in-cluster", nil
+	}
+	kc, source, kerr := NewKubeconfigK8sClient()
+	if kerr != nil {
+		return nil, "", fmt.Errorf("in-cluster: %v; kubeconfig: %w", err, kerr)
+	}
+	return kc, source, nil
+}
+
+func newK8sClient(baseURL, namespace, token string, tlsConfig *tls.Config) *K8sClient {
+	kc := &K8sClient{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		namespace: namespace,
+		jobs:      newJobCache(),
+		tlsConfig: tlsConfig,
+		token:     token,
+	}
+	kc.setTLSConfig(tlsConfig)
+	if token != "" {
+		logTokenExpiry("loaded", token)
+	}
+	return kc
+}
+
+// setTLSConfig gives the client fresh HTTP clients for cfg. Requests in
+// flight, including a running watch, finish on the old ones.
+func (kc *K8sClient) setTLSConfig(cfg *tls.Config) {
+	tr := &http.Transport{TLSClientConfig: cfg}
+	kc.mu.Lock()
+	old := kc.httpc
+	kc.httpc = &http.Client{Transport: tr, Timeout: 10 * time.Second}
+	kc.watchc = &http.Client{Transport: tr}
+	kc.mu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+func (kc *K8sClient) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
 	var rdr io.Reader
 	if body != nil {
-		b, err := json.Marshal(body)
-		if err != nil {
-			return nil, err
-		}
-		rdr = bytes.NewReader(b)
+		rdr = bytes.NewReader(body)
 	}
 	req, err := http.NewRequestWithContext(ctx, method, kc.baseURL+path, rdr)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+kc.token)
+	kc.mu.RLock()
+	token := kc.token
+	kc.mu.RUnlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 	req.Header.Set("Accept", "application/json")
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// send performs a request, with the watch client when watch is set. A 401
+// usually means the token was rotated since it was last read, so the
+// credentials are reloaded and, if the token changed, the request is tried
+// once more.
+func (kc *K8sClient) send(ctx context.Context, method, path, contentType string, body []byte, watch bool) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := kc.newRequest(ctx, method, path, body)
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		kc.mu.RLock()
+		c := kc.httpc
+		if watch {
+			c = kc.watchc
+		}
+		kc.mu.RUnlock()
+		resp, err := c.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, err
+		}
+		tokenChanged, err := kc.reloadCredentials()
+		if err != nil {
+			log.Printf("[k8s] reload credentials after 401: %v", err)
+		}
+		if !tokenChanged {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Printf("[k8s] %s %s: 401, retrying with the reloaded token", method, path)
 	}
-	return kc.httpc.Do(req)
 }
 
-func (kc *K8sClient) doRaw(ctx context.Context, method, path, contentType string, data []byte) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, method, kc.baseURL+path, bytes.NewReader(data))
+func (kc *K8sClient) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	if body == nil {
+		return kc.send(ctx, method, path, "", nil, false)
+	}
+	b, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+kc.token)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", contentType)
-	return kc.httpc.Do(req)
+	return kc.send(ctx, method, path, "application/json", b, false)
 }
 
-func (kc *K8sClient) CreateImageEffectJob(ctx context.Context, image, redisAddr, postID, effect string) (string, error) {
+func (kc *K8sClient) doRaw(ctx context.Context, method, path, contentType string, data []byte) (*http.Response, error) {
+	return kc.send(ctx, method, path, contentType, data, false)
+}
+
+// ImageEffectJob holds the values substituted into the Job template.
+type ImageEffectJob struct {
+	Image     string
+	RedisAddr string
+	PostID    string
+	ImageID   string // the gallery image to process
+	Variant   string
+	Pipeline  []byte // JSON list of effect steps
+	Format    string // output format; empty keeps the source format
+	Quality   int    // JPEG quality; 0 selects the job's default
+	Thumbs    string // comma-separated thumbnail widths to render
+	Blob      BlobConfig
+}
+
+func (kc *K8sClient) CreateImageEffectJob(ctx context.Context, job ImageEffectJob) (string, error) {
 	suffix, _ := randomID(4)
-	name := fmt.Sprintf("imgfx-%s-%s", strings.ToLower(postID), strings.ToLower(suffix))
+	name := fmt.Sprintf("imgfx-%s-%s", strings.ToLower(job.PostID), strings.ToLower(suffix))
 	tmplPath := getenv("JOB_TEMPLATE_PATH", "/app/job.yaml")
 	data, err := os.ReadFile(tmplPath)
 	if err != nil {
 		return "", fmt.Errorf("read job template: %w", err)
 	}
+	// A JSON string literal is also a valid YAML double-quoted scalar, so
+	// the pipeline survives the template without further escaping.
+	pipeline, err := json.Marshal(string(job.Pipeline))
+	if err != nil {
+		return "", fmt.Errorf("encode pipeline: %w", err)
+	}
 	yaml := strings.NewReplacer(
 		"{{NAME}}", name,
 		"{{NAMESPACE}}", kc.namespace,
-		"{{IMAGE}}", image,
-		"{{REDIS_ADDR}}", redisAddr,
-		"{{POST_ID}}", postID,
-		"{{EFFECT}}", effect,
+		"{{IMAGE}}", job.Image,
+		"{{REDIS_ADDR}}", job.RedisAddr,
+		"{{POST_ID}}", job.PostID,
+		"{{IMAGE_ID}}", job.ImageID,
+		"{{VARIANT}}", job.Variant,
+		"{{PIPELINE}}", string(pipeline),
+		"{{OUTPUT_FORMAT}}", job.Format,
+		"{{OUTPUT_QUALITY}}", strconv.Itoa(job.Quality),
+		"{{THUMB_WIDTHS}}", job.Thumbs,
+		"{{BLOB_STORE}}", job.Blob.Backend,
+		"{{BLOB_DIR}}", job.Blob.Dir,
+		"{{BLOB_VOLUME}}", blobVolume(job.Blob),
+		"{{S3_ENDPOINT}}", job.Blob.S3Endpoint,
+		"{{S3_BUCKET}}", job.Blob.S3Bucket,
+		"{{S3_REGION}}", job.Blob.S3Region,
+		"{{S3_PATH_STYLE}}", strconv.FormatBool(job.Blob.S3PathStyle),
+		"{{S3_CREDENTIALS_SECRET}}", getenv("S3_CREDENTIALS_SECRET", "image-blob-s3"),
 	).Replace(string(data))
 	resp, err := kc.doRaw(ctx, http.MethodPost, "/apis/batch/v1/namespaces/"+kc.namespace+"/jobs", "application/yaml", []byte(yaml))
 	if err != nil {
@@ -110,58 +241,291 @@ func (kc *K8sClient) CreateImageEffectJob(ctx context.Context, image, redisAddr,
 		b, _ := io.ReadAll(resp.Body)
 		return "", fmt.Errorf("create job http %d: %s", resp.StatusCode, string(b))
 	}
+	// The watch usually reports the new Job within moments; until it does,
+	// polls are answered from here rather than missing the cache.
+	kc.jobs.add(name, jobState{Status: "pending"})
 	return name, nil
 }
 
+// blobVolume is the volume source for the job's blob mount: the shared claim
+// for the filesystem backend, otherwise an unused emptyDir. Flow style keeps
+// it on the one template line.
+func blobVolume(cfg BlobConfig) string {
+	if cfg.Backend == "fs" && cfg.PVC != "" {
+		return fmt.Sprintf("persistentVolumeClaim: {claimName: %q}", cfg.PVC)
+	}
+	return "emptyDir: {}"
+}
+
+// errJobNotFound is returned when the API server has no such Job.
+var errJobNotFound = errors.New("job not found")
+
+// JobStatus asks the API server for the status of a Job. Status polls are
+// normally answered by the watch cache; this is the fallback for Jobs it
+// does not know about.
 func (kc *K8sClient) JobStatus(ctx context.Context, name string) (string, string, error) {
-	resp, err := kc.do(ctx, http.MethodGet, "/apis/batch/v1/namespaces/"+kc.namespace+"/jobs/"+name, nil)
+	doc, err := kc.getJob(ctx, name)
 	if err != nil {
 		return "", "", err
 	}
+	st := doc.state()
+	return st.Status, st.Reason, nil
+}
+
+func (kc *K8sClient) jobPath(name string) string {
+	return "/apis/batch/v1/namespaces/" + kc.namespace + "/jobs/" + name
+}
+
+func (kc *K8sClient) getJob(ctx context.Context, name string) (*jobObject, error) {
+	resp, err := kc.do(ctx, http.MethodGet, kc.jobPath(name), nil)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errJobNotFound
+	}
 	if resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(resp.Body)
-		return "", "", fmt.Errorf("get job http %d: %s", resp.StatusCode, string(b))
-	}
-	var doc struct {
-		Status struct {
-			Succeeded  *int `json:"succeeded,omitempty"`
-			Failed     *int `json:"failed,omitempty"`
-			Active     *int `json:"active,omitempty"`
-			Conditions []struct {
-				Type    string `json:"type"`
-				Status  string `json:"status"`
-				Reason  string `json:"reason,omitempty"`
-				Message string `json:"message,omitempty"`
-			} `json:"conditions,omitempty"`
-		} `json:"status"`
+		return nil, fmt.Errorf("get job http %d: %s", resp.StatusCode, string(b))
 	}
+	var doc jobObject
 	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
-		return "", "", err
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// getOwnJob is getJob for Jobs created by this API, refusing any other
+// with errJobNotOurs.
+func (kc *K8sClient) getOwnJob(ctx context.Context, name string) (*jobObject, error) {
+	doc, err := kc.getJob(ctx, name)
+	if err != nil {
+		return nil, err
 	}
+	if doc.Metadata.Labels["app"] != "image-effect" {
+		return nil, errJobNotOurs
+	}
+	return doc, nil
+}
+
+// jobObject is the part of a batch/v1 Job the API reads.
+type jobObject struct {
+	Metadata struct {
+		Name              string            `json:"name"`
+		UID               string            `json:"uid"`
+		ResourceVersion   string            `json:"resourceVersion"`
+		Labels            map[string]string `json:"labels"`
+		Annotations       map[string]string `json:"annotations"`
+		CreationTimestamp *time.Time        `json:"creationTimestamp,omitempty"`
+		DeletionTimestamp *string           `json:"deletionTimestamp,omitempty"`
+	} `json:"metadata"`
+	Status struct {
+		Succeeded      *int       `json:"succeeded,omitempty"`
+		Failed         *int       `json:"failed,omitempty"`
+		Active         *int       `json:"active,omitempty"`
+		StartTime      *time.Time `json:"startTime,omitempty"`
+		CompletionTime *time.Time `json:"completionTime,omitempty"`
+		Conditions     []struct {
+			Type               string     `json:"type"`
+			Status             string     `json:"status"`
+			Reason             string     `json:"reason,omitempty"`
+			Message            string     `json:"message,omitempty"`
+			LastTransitionTime *time.Time `json:"lastTransitionTime,omitempty"`
+		} `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+// state condenses the Job status into succeeded, failed, cancelled (being
+// deleted), running or pending, with the failure reason when there is one.
+func (doc *jobObject) state() jobState {
 	if doc.Status.Succeeded != nil && *doc.Status.Succeeded > 0 {
-		return "succeeded", "", nil
+		return jobState{Status: "succeeded"}
 	}
 	if doc.Status.Failed != nil && *doc.Status.Failed > 0 {
 		for _, c := range doc.Status.Conditions {
 			if strings.EqualFold(c.Type, "Failed") && strings.EqualFold(c.Status, "True") {
-				return "failed", firstNonEmpty(c.Reason, c.Message), nil
+				return jobState{Status: "failed", Reason: firstNonEmpty(c.Reason, c.Message)}
 			}
 		}
-		return "failed", "", nil
+		return jobState{Status: "failed"}
 	}
 	for _, c := range doc.Status.Conditions {
 		if strings.EqualFold(c.Type, "Complete") && strings.EqualFold(c.Status, "True") {
-			return "succeeded", "", nil
+			return jobState{Status: "succeeded"}
 		}
 		if strings.EqualFold(c.Type, "Failed") && strings.EqualFold(c.Status, "True") {
-			return "failed", firstNonEmpty(c.Reason, c.Message), nil
+			return jobState{Status: "failed", Reason: firstNonEmpty(c.Reason, c.Message)}
 		}
 	}
+	if doc.Metadata.DeletionTimestamp != nil {
+		return jobState{Status: "cancelled"}
+	}
 	if doc.Status.Active != nil && *doc.Status.Active > 0 {
-		return "running", "", nil
+		return jobState{Status: "running"}
+	}
+	return jobState{Status: "pending"}
+}
+
+// finishedAt is when the Job completed or failed, if it has.
+func (doc *jobObject) finishedAt() *time.Time {
+	if doc.Status.CompletionTime != nil {
+		return doc.Status.CompletionTime
+	}
+	for _, c := range doc.Status.Conditions {
+		if (strings.EqualFold(c.Type, "Complete") || strings.EqualFold(c.Type, "Failed")) && strings.EqualFold(c.Status, "True") {
+			return c.LastTransitionTime
+		}
+	}
+	return nil
+}
+
+// ListJobs returns the image-effect Jobs that also match selector, which
+// may be empty.
+func (kc *K8sClient) ListJobs(ctx context.Context, selector string) ([]jobObject, error) {
+	if selector != "" {
+		selector = imageJobSelector + "," + selector
+	} else {
+		selector = imageJobSelector
+	}
+	q := url.Values{"labelSelector": {selector}}
+	resp, err := kc.do(ctx, http.MethodGet, "/apis/batch/v1/namespaces/"+kc.namespace+"/jobs?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list jobs http %d: %s", resp.StatusCode, string(b))
+	}
+	var list struct {
+		Items []jobObject `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// finished reports whether the state is final.
+func (st jobState) finished() bool {
+	return st.Status == "succeeded" || st.Status == "failed" || st.Status == "cancelled"
+}
+
+var (
+	errJobNotOurs  = errors.New("job was not created by this API")
+	errJobFinished = errors.New("job already finished")
+)
+
+// CancelJob deletes a running effect Job together with its pods. Jobs
+// without the image-effect label are refused, as are Jobs that have
+// already finished, whose outcome would otherwise be lost.
+func (kc *K8sClient) CancelJob(ctx context.Context, name string) error {
+	doc, err := kc.getOwnJob(ctx, name)
+	if err != nil {
+		return err
+	}
+	if doc.state().finished() {
+		return errJobFinished
+	}
+	// Background propagation lets the garbage collector remove the pods
+	// after the Job is gone; the UID precondition makes sure the Job
+	// checked above is the one deleted.
+	opts := map[string]any{
+		"kind":              "DeleteOptions",
+		"apiVersion":        "v1",
+		"propagationPolicy": "Background",
+		"preconditions":     map[string]string{"uid": doc.Metadata.UID},
+	}
+	resp, err := kc.do(ctx, http.MethodDelete, kc.jobPath(name), opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errJobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("delete job http %d: %s", resp.StatusCode, string(b))
+	}
+	kc.jobs.set(name, jobState{Status: "cancelled"})
+	return nil
+}
+
+var (
+	errNoJobPod      = errors.New("job has no pod yet")
+	errPodNotStarted = errors.New("job pod has not started")
+)
+
+// JobLogs opens the log of the job container in the newest pod of an
+// effect Job, found through the job-name label the Job controller sets.
+// With follow the stream stays open until the container exits or ctx is
+// done; tail > 0 starts that many lines from the end.
+func (kc *K8sClient) JobLogs(ctx context.Context, name string, follow bool, tail int) (io.ReadCloser, error) {
+	if _, err := kc.getOwnJob(ctx, name); err != nil {
+		return nil, err
+	}
+	q := url.Values{"labelSelector": {"job-name=" + name}}
+	resp, err := kc.do(ctx, http.MethodGet, "/api/v1/namespaces/"+kc.namespace+"/pods?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list pods http %d: %s", resp.StatusCode, string(b))
+	}
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				Name              string    `json:"name"`
+				CreationTimestamp time.Time `json:"creationTimestamp"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, errNoJobPod
+	}
+	// A Job that retried has a pod per attempt; the newest has the most
+	// relevant log.
+	pod := pods.Items[0].Metadata
+	for _, p := range pods.Items[1:] {
+		if p.Metadata.CreationTimestamp.After(pod.CreationTimestamp) {
+			pod = p.Metadata
+		}
+	}
+
+	lq := url.Values{"container": {"job"}}
+	if follow {
+		lq.Set("follow", "true")
+	}
+	if tail > 0 {
+		lq.Set("tailLines", strconv.Itoa(tail))
+	}
+	// The watch client has no overall timeout, which a followed log needs.
+	lresp, err := kc.send(ctx, http.MethodGet, "/api/v1/namespaces/"+kc.namespace+"/pods/"+pod.Name+"/log?"+lq.Encode(), "", nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if lresp.StatusCode == http.StatusBadRequest {
+		// Answered while the container is still waiting to start.
+		defer lresp.Body.Close()
+		var st struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(lresp.Body).Decode(&st)
+		return nil, fmt.Errorf("%w: %s", errPodNotStarted, st.Message)
+	}
+	if lresp.StatusCode >= 300 {
+		defer lresp.Body.Close()
+		b, _ := io.ReadAll(lresp.Body)
+		return nil, fmt.Errorf("pod log http %d: %s", lresp.StatusCode, string(b))
 	}
-	return "pending", "", nil
+	return lresp.Body, nil
 }
 
 func firstNonEmpty(s ...string) string {
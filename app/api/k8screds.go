@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Projected service account tokens are rotated by the kubelet, by default
+// hourly, and the CA bundle can be rotated with the cluster. Both are
+// re-read from disk on an interval, and whenever the API server answers 401.
+
+// RefreshCredentials reloads the token and CA bundle every interval until
+// ctx is done. It does nothing for clients without files to reload, or
+// when interval is not positive.
+func (kc *K8sClient) RefreshCredentials(ctx context.Context, interval time.Duration) {
+	if interval <= 0 || (kc.tokenFile == "" && kc.caFile == "") {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := kc.reloadCredentials(); err != nil {
+				log.Printf("[k8s] reload credentials: %v", err)
+			}
+		}
+	}
+}
+
+// reloadCredentials re-reads the token and CA files, swapping in whatever
+// changed, and reports whether the token did. A file that cannot be read
+// or parsed leaves the current value in place.
+func (kc *K8sClient) reloadCredentials() (bool, error) {
+	var errs []string
+	tokenChanged := false
+	if kc.tokenFile != "" {
+		b, err := os.ReadFile(kc.tokenFile)
+		token := strings.TrimSpace(string(b))
+		switch {
+		case err != nil:
+			errs = append(errs, err.Error())
+		case token == "":
+			errs = append(errs, kc.tokenFile+": empty token")
+		default:
+			kc.mu.Lock()
+			tokenChanged = token != kc.token
+			kc.token = token
+			kc.mu.Unlock()
+			if tokenChanged {
+				logTokenExpiry("reloaded", token)
+			}
+		}
+	}
+	if kc.caFile != "" {
+		if err := kc.reloadCA(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return tokenChanged, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return tokenChanged, nil
+}
+
+func (kc *K8sClient) reloadCA() error {
+	ca, err := os.ReadFile(kc.caFile)
+	if err != nil {
+		return err
+	}
+	kc.mu.RLock()
+	same := bytes.Equal(ca, kc.caPEM)
+	kc.mu.RUnlock()
+	if same {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("%s: no certificates", kc.caFile)
+	}
+	cfg := kc.tlsConfig.Clone()
+	cfg.RootCAs = pool
+	kc.setTLSConfig(cfg)
+	kc.mu.Lock()
+	kc.caPEM = ca
+	kc.mu.Unlock()
+	log.Printf("[k8s] reloaded CA bundle from %s", kc.caFile)
+	return nil
+}
+
+// logTokenExpiry logs when a bearer token expires. Service account tokens
+// are JWTs; the claims are read without verifying the signature, which is
+// the API server's job.
+func logTokenExpiry(what, token string) {
+	exp, ok := tokenExpiry(token)
+	switch {
+	case !ok:
+		log.Printf("[k8s] bearer token %s (no expiry)", what)
+	case time.Until(exp) <= 0:
+		log.Printf("[k8s] bearer token %s, expired at %s", what, exp.Format(time.RFC3339))
+	default:
+		log.Printf("[k8s] bearer token %s, expires at %s (in %s)", what, exp.Format(time.RFC3339), time.Until(exp).Round(time.Second))
+	}
+}
+
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NewKubeconfigK8sClient connects the way kubectl would outside a cluster:
+// the files in KUBECONFIG (default ~/.kube/config), the current context or
+// the one named by KUBE_CONTEXT, and that context's cluster, user and
+// namespace. Credentials may be client certificates or bearer tokens;
+// exec plugins and auth providers are not run. The returned string names
+// the context, for logging.
+func NewKubeconfigK8sClient() (*K8sClient, string, error) {
+	paths := kubeconfigPaths()
+	if len(paths) == 0 {
+		return nil, "", errors.New("no kubeconfig: KUBECONFIG not set and no home directory")
+	}
+	cfg, err := loadKubeconfig(paths)
+	if err != nil {
+		return nil, "", err
+	}
+	name := cfg.CurrentContext
+	if v := os.Getenv("KUBE_CONTEXT"); v != "" {
+		name = v
+	}
+	if name == "" {
+		return nil, "", fmt.Errorf("%s: no current-context", strings.Join(paths, ":"))
+	}
+	ctx, ok := cfg.Contexts[name]
+	if !ok {
+		return nil, "", fmt.Errorf("context %q not found", name)
+	}
+	cluster, ok := cfg.Clusters[ctx.Cluster]
+	if !ok {
+		return nil, "", fmt.Errorf("context %q: cluster %q not found", name, ctx.Cluster)
+	}
+	user, ok := cfg.Users[ctx.User]
+	if !ok && ctx.User != "" {
+		return nil, "", fmt.Errorf("context %q: user %q not found", name, ctx.User)
+	}
+	if cluster.Server == "" {
+		return nil, "", fmt.Errorf("cluster %q has no server", ctx.Cluster)
+	}
+	if user.Exec && user.Token == "" && user.TokenFile == "" && user.CertData == "" && user.CertFile == "" {
+		return nil, "", fmt.Errorf("user %q: exec and auth-provider credentials are not supported; use a token or client certificate", ctx.User)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cluster.InsecureSkipVerify, ServerName: cluster.TLSServerName}
+	ca, err := kubeconfigData(cluster.CAData, cluster.CAFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("cluster %q: certificate-authority: %w", ctx.Cluster, err)
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, "", fmt.Errorf("cluster %q: no certificates in certificate-authority", ctx.Cluster)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	cert, err := kubeconfigData(user.CertData, user.CertFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("user %q: client-certificate: %w", ctx.User, err)
+	}
+	key, err := kubeconfigData(user.KeyData, user.KeyFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("user %q: client-key: %w", ctx.User, err)
+	}
+	if cert != nil || key != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, "", fmt.Errorf("user %q: client certificate: %w", ctx.User, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	token := user.Token
+	if token == "" && user.TokenFile != "" {
+		b, err := os.ReadFile(user.TokenFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("user %q: tokenFile: %w", ctx.User, err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	ns := ctx.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+	kc := newK8sClient(cluster.Server, ns, token, tlsConfig)
+	if user.Token == "" {
+		kc.tokenFile = user.TokenFile
+	}
+	if cluster.CAData == "" {
+		kc.caFile, kc.caPEM = cluster.CAFile, ca
+	}
+	return kc, "kubeconfig context " + name, nil
+}
+
+// kubeconfigPaths lists the kubeconfig files to read, in precedence order.
+func kubeconfigPaths() []string {
+	if v := os.Getenv("KUBECONFIG"); v != "" {
+		var paths []string
+		for _, p := range filepath.SplitList(v) {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+		return paths
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{filepath.Join(home, ".kube", "config")}
+}
+
+// kubeconfigData returns inline base64 data if set, otherwise the contents
+// of file, otherwise nil.
+func kubeconfigData(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string
+	Clusters       map[string]kubeCluster
+	Contexts       map[string]kubeContext
+	Users          map[string]kubeUser
+}
+
+type kubeCluster struct {
+	Server             string
+	CAFile, CAData     string
+	InsecureSkipVerify bool
+	TLSServerName      string
+}
+
+type kubeContext struct {
+	Cluster, User, Namespace string
+}
+
+type kubeUser struct {
+	Token, TokenFile   string
+	CertFile, CertData string
+	KeyFile, KeyData   string
+	Exec               bool // credentials come from a plugin or auth provider
+}
+
+// loadKubeconfig merges the given files the way kubectl does: the first
+// file to set current-context wins, as does the first definition of each
+// named cluster, context and user. Missing files are skipped unless none
+// exist. Relative paths inside a file are taken relative to that file.
+func loadKubeconfig(paths []string) (*kubeconfig, error) {
+	cfg := &kubeconfig{
+		Clusters: map[string]kubeCluster{},
+		Contexts: map[string]kubeContext{},
+		Users:    map[string]kubeUser{},
+	}
+	found := false
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		doc, err := parseKubeconfigDoc(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		cfg.merge(doc, filepath.Dir(p))
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: %w", strings.Join(paths, ":"), os.ErrNotExist)
+	}
+	return cfg, nil
+}
+
+func (cfg *kubeconfig) merge(doc map[string]any, dir string) {
+	if cfg.CurrentContext == "" {
+		cfg.CurrentContext = yamlString(doc["current-context"])
+	}
+	path := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for name, c := range namedEntries(doc, "clusters", "cluster") {
+		if _, ok := cfg.Clusters[name]; !ok {
+			skip, _ := strconv.ParseBool(yamlString(c["insecure-skip-tls-verify"]))
+			cfg.Clusters[name] = kubeCluster{
+				Server:             yamlString(c["server"]),
+				CAFile:             path(yamlString(c["certificate-authority"])),
+				CAData:             yamlString(c["certificate-authority-data"]),
+				InsecureSkipVerify: skip,
+				TLSServerName:      yamlString(c["tls-server-name"]),
+			}
+		}
+	}
+	for name, c := range namedEntries(doc, "contexts", "context") {
+		if _, ok := cfg.Contexts[name]; !ok {
+			cfg.Contexts[name] = kubeContext{
+				Cluster:   yamlString(c["cluster"]),
+				User:      yamlString(c["user"]),
+				Namespace: yamlString(c["namespace"]),
+			}
+		}
+	}
+	for name, u := range namedEntries(doc, "users", "user") {
+		if _, ok := cfg.Users[name]; !ok {
+			cfg.Users[name] = kubeUser{
+				Token:     yamlString(u["token"]),
+				TokenFile: path(yamlString(u["tokenFile"])),
+				CertFile:  path(yamlString(u["client-certificate"])),
+				CertData:  yamlString(u["client-certificate-data"]),
+				KeyFile:   path(yamlString(u["client-key"])),
+				KeyData:   yamlString(u["client-key-data"]),
+				Exec:      u["exec"] != nil || u["auth-provider"] != nil,
+			}
+		}
+	}
+}
+
+// namedEntries reads a kubeconfig list such as clusters, where each item is
+// {name: ..., <field>: {...}}, into a map by name.
+func namedEntries(doc map[string]any, list, field string) map[string]map[string]any {
+	out := map[string]map[string]any{}
+	items, _ := doc[list].([]any)
+	for _, it := range items {
+		m, _ := it.(map[string]any)
+		name := yamlString(m["name"])
+		if name == "" {
+			continue
+		}
+		body, _ := m[field].(map[string]any)
+		if body == nil {
+			body = map[string]any{}
+		}
+		out[name] = body
+	}
+	return out
+}
+
+func yamlString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+// parseKubeconfigDoc parses a kubeconfig, which may be JSON or YAML.
+func parseKubeconfigDoc(data []byte) (map[string]any, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		var doc map[string]any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		stringifyJSON(doc)
+		return doc, nil
+	}
+	v, err := parseYAML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	doc, _ := v.(map[string]any)
+	if doc == nil {
+		return nil, errors.New("not a kubeconfig mapping")
+	}
+	return doc, nil
+}
+
+// stringifyJSON turns the booleans and numbers of a decoded JSON document
+// into strings, matching what parseYAML returns for scalars.
+func stringifyJSON(v any) {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, e := range t {
+			t[k] = jsonScalar(e)
+			stringifyJSON(t[k])
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = jsonScalar(e)
+			stringifyJSON(t[i])
+		}
+	}
+}
+
+func jsonScalar(v any) any {
+	switch t := v.(type) {
+	case bool:
+		return strconv.FormatBool(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return v
+}
+
+// parseYAML handles the block-style YAML that kubectl, kind and minikube
+// write: nested mappings and sequences, plain and quoted scalars, empty
+// {} and [], and comments. Scalars are returned as strings. Anchors,
+// multi-line scalars and other flow collections are rejected rather than
+// misread.
+func parseYAML(src string) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(src, "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{no: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].no)
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	no     int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// block parses the mapping or sequence whose entries start at column indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	if isSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	out := []any{}
+	for p.pos < len(p.lines) {
+		ln := p.lines[p.pos]
+		if ln.indent != indent || !isSeqItem(ln.text) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(ln.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok {
+			// "- key: value" opens a mapping whose keys line up with key.
+			p.lines[p.pos] = yamlLine{no: ln.no, indent: ln.indent + len(ln.text) - len(rest), text: rest}
+			v, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		v, err := yamlScalar(rest, ln.no)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		p.pos++
+	}
+	return out, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	out := map[string]any{}
+	for p.pos < len(p.lines) {
+		ln := p.lines[p.pos]
+		if ln.indent < indent {
+			break
+		}
+		if ln.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", ln.no)
+		}
+		if isSeqItem(ln.text) {
+			break
+		}
+		key, val, ok := splitYAMLKey(ln.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", ln.no)
+		}
+		p.pos++
+		if val != "" {
+			v, err := yamlScalar(val, ln.no)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = v
+			continue
+		}
+		// A sequence under a key may sit at the key's own indentation.
+		v, err := p.nested(indent, true)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+// nested parses the block below an entry at column indent, or returns nil
+// when the entry is empty. sameIndentSeq allows a sequence at indent itself.
+func (p *yamlParser) nested(indent int, sameIndentSeq bool) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || (sameIndentSeq && next.indent == indent && isSeqItem(next.text)) {
+		return p.block(next.indent)
+	}
+	return nil, nil
+}
+
+// splitYAMLKey splits "key: value" or "key:" at the first colon followed by
+// a space or the end of the line, outside quotes.
+func splitYAMLKey(text string) (key, val string, ok bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", false
+		}
+		rest := text[end+2:]
+		if !strings.HasPrefix(rest, ":") || (len(rest) > 1 && rest[1] != ' ') {
+			return "", "", false
+		}
+		k, err := yamlScalar(text[:end+2], 0)
+		if err != nil {
+			return "", "", false
+		}
+		return k.(string), strings.TrimSpace(rest[1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func yamlScalar(s string, line int) (any, error) {
+	switch {
+	case s == "{}":
+		return map[string]any{}, nil
+	case s == "[]":
+		return []any{}, nil
+	case s == "~" || s == "null":
+		return nil, nil
+	case s[0] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad double-quoted string", line)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("line %d: bad single-quoted string", line)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsRune("{[&*!|>", rune(s[0])):
+		return nil, fmt.Errorf("line %d: unsupported YAML %q", line, s[:1])
+	}
+	return s, nil
+}
+
+// stripYAMLComment drops a trailing # comment, which starts a line or
+// follows whitespace, unless it is inside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			switch {
+			case c == '\'' && quote == '\'' && i+1 < len(line) && line[i+1] == '\'':
+				i++ // '' is an escaped quote
+			case c == quote:
+				quote = 0
+			case c == '\\' && quote == '"':
+				i++
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || line[i-1] == ' ' || line[i-1] == ':' || line[i-1] == '-' {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// kindConfig is what `kind create cluster` writes, certificates shortened.
+const kindConfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: LS0tLS1CRUdJTiBDRVJU
+    server: https://127.0.0.1:40537
+  name: kind-kind
+contexts:
+- context:
+    cluster: kind-kind
+    user: kind-kind
+  name: kind-kind
+current-context: kind-kind
+kind: Config
+preferences: {}
+users:
+- name: kind-kind
+  user:
+    client-certificate-data: LS0tLS1DRVJU
+    client-key-data: LS0tLS1LRVk=
+`
+
+// minikubeConfig is what `minikube start` writes: file paths and
+// extensions lists with timestamps.
+const minikubeConfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority: /home/dev/.minikube/ca.crt
+    extensions:
+    - extension:
+        last-update: Fri, 16 Oct 2026 10:12:01 UTC
+        provider: minikube.sigs.k8s.io
+        version: v1.34.0
+      name: cluster_info
+    server: https://192.168.49.2:8443
+  name: minikube
+contexts:
+- context:
+    cluster: minikube
+    extensions:
+    - extension:
+        last-update: Fri, 16 Oct 2026 10:12:01 UTC
+        provider: minikube.sigs.k8s.io
+        version: v1.34.0
+      name: context_info
+    namespace: default
+    user: minikube
+  name: minikube
+current-context: minikube
+kind: Config
+preferences: {}
+users:
+- name: minikube
+  user:
+    client-certificate: /home/dev/.minikube/profiles/minikube/client.crt
+    client-key: /home/dev/.minikube/profiles/minikube/client.key
+`
+
+// kubectlConfig is hand-edited the way `kubectl config` output often ends
+// up: comments, quoted keys and values, indented lists, an exec user.
+const kubectlConfig = `# managed by hand
+apiVersion: v1
+kind: Config
+"current-context": 'staging'   # switch with kubectl config use-context
+clusters:
+  - name: "staging"
+    cluster:
+      server: "https://staging.example.com:6443"  # API server
+      insecure-skip-tls-verify: true
+      tls-server-name: 'api.staging # internal'
+contexts:
+  - name: staging
+    context:
+      cluster: staging
+      user: "ci-bot"
+      namespace: blog
+  - name: gke
+    context:
+      cluster: staging
+      user: gke-user
+users:
+  - name: "ci-bot"
+    user:
+      token: "abc#123"
+  - name: gke-user
+    user:
+      exec:
+        apiVersion: client.authentication.k8s.io/v1beta1
+        command: gke-gcloud-auth-plugin
+        args: null
+        installHint: 'Install it with: gcloud components install'
+        provideClusterInfo: true
+`
+
+// jsonConfig is the JSON form, as written by `kubectl config view -o json`.
+const jsonConfig = `{
+  "kind": "Config",
+  "apiVersion": "v1",
+  "clusters": [
+    {"name": "json", "cluster": {"server": "https://10.0.0.1", "insecure-skip-tls-verify": true}}
+  ],
+  "users": [{"name": "json", "user": {"tokenFile": "token"}}],
+  "contexts": [{"name": "json", "context": {"cluster": "json", "user": "json"}}],
+  "current-context": "json"
+}
+`
+
+func writeKubeconfig(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadKubeconfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		src  string
+		want *kubeconfig
+	}{
+		{"kind", kindConfig, &kubeconfig{
+			CurrentContext: "kind-kind",
+			Clusters:       map[string]kubeCluster{"kind-kind": {Server: "https://127.0.0.1:40537", CAData: "LS0tLS1CRUdJTiBDRVJU"}},
+			Contexts:       map[string]kubeContext{"kind-kind": {Cluster: "kind-kind", User: "kind-kind"}},
+			Users:          map[string]kubeUser{"kind-kind": {CertData: "LS0tLS1DRVJU", KeyData: "LS0tLS1LRVk="}},
+		}},
+		{"minikube", minikubeConfig, &kubeconfig{
+			CurrentContext: "minikube",
+			Clusters:       map[string]kubeCluster{"minikube": {Server: "https://192.168.49.2:8443", CAFile: "/home/dev/.minikube/ca.crt"}},
+			Contexts:       map[string]kubeContext{"minikube": {Cluster: "minikube", User: "minikube", Namespace: "default"}},
+			Users: map[string]kubeUser{"minikube": {
+				CertFile: "/home/dev/.minikube/profiles/minikube/client.crt",
+				KeyFile:  "/home/dev/.minikube/profiles/minikube/client.key",
+			}},
+		}},
+		{"kubectl", kubectlConfig, &kubeconfig{
+			CurrentContext: "staging",
+			Clusters: map[string]kubeCluster{"staging": {
+				Server:             "https://staging.example.com:6443",
+				InsecureSkipVerify: true,
+				TLSServerName:      "api.staging # internal",
+			}},
+			Contexts: map[string]kubeContext{
+				"staging": {Cluster: "staging", User: "ci-bot", Namespace: "blog"},
+				"gke":     {Cluster: "staging", User: "gke-user"},
+			},
+			Users: map[string]kubeUser{
+				"ci-bot":   {Token: "abc#123"},
+				"gke-user": {Exec: true},
+			},
+		}},
+		{"json", jsonConfig, &kubeconfig{
+			CurrentContext: "json",
+			Clusters:       map[string]kubeCluster{"json": {Server: "https://10.0.0.1", InsecureSkipVerify: true}},
+			Contexts:       map[string]kubeContext{"json": {Cluster: "json", User: "json"}},
+			Users:          map[string]kubeUser{"json": {TokenFile: filepath.Join(dir, "token")}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeKubeconfig(t, dir, tt.name, tt.src)
+			got, err := loadKubeconfig([]string{p})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadKubeconfigMerge(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(root, d), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := writeKubeconfig(t, root, "a/config", `
+current-context: one
+clusters:
+- name: shared
+  cluster:
+    server: https://first
+    certificate-authority: ca.crt
+users:
+- name: shared
+  user:
+    client-certificate: certs/client.crt
+    client-key: /etc/keys/client.key
+`)
+	second := writeKubeconfig(t, root, "b/config", `
+current-context: two
+clusters:
+- name: shared
+  cluster:
+    server: https://second
+- name: only-second
+  cluster:
+    server: https://only-second
+    certificate-authority: ../ca.crt
+contexts:
+- name: one
+  context:
+    cluster: shared
+    user: shared
+`)
+
+	t.Run("precedence", func(t *testing.T) {
+		// Missing files are skipped; the first file wins every conflict,
+		// and relative paths resolve against the file that holds them.
+		missing := filepath.Join(root, "missing")
+		cfg, err := loadKubeconfig([]string{first, missing, second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &kubeconfig{
+			CurrentContext: "one",
+			Clusters: map[string]kubeCluster{
+				"shared":      {Server: "https://first", CAFile: filepath.Join(root, "a", "ca.crt")},
+				"only-second": {Server: "https://only-second", CAFile: filepath.Join(root, "ca.crt")},
+			},
+			Contexts: map[string]kubeContext{"one": {Cluster: "shared", User: "shared"}},
+			Users: map[string]kubeUser{"shared": {
+				CertFile: filepath.Join(root, "a", "certs", "client.crt"),
+				KeyFile:  "/etc/keys/client.key",
+			}},
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("got  %+v\nwant %+v", cfg, want)
+		}
+	})
+
+	t.Run("reversed", func(t *testing.T) {
+		cfg, err := loadKubeconfig([]string{second, first})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.CurrentContext != "two" || cfg.Clusters["shared"].Server != "https://second" {
+			t.Errorf("the file listed first should win: %+v", cfg)
+		}
+	})
+
+	t.Run("none exist", func(t *testing.T) {
+		_, err := loadKubeconfig([]string{filepath.Join(root, "x"), filepath.Join(root, "y")})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("got %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"empty", "# nothing\n\n", map[string]any{}},
+		{"scalars", "a: b\nc: 'it''s'\nd: \"x\\ty\"\ne: ~\nf: {}\ng: []\n", map[string]any{
+			"a": "b", "c": "it's", "d": "x\ty", "e": nil, "f": map[string]any{}, "g": []any{},
+		}},
+		{"document marker and CRLF", "---\r\na: b\r\n", map[string]any{"a": "b"}},
+		{"colon in value", "url: https://h:443/p\ntime: 10:12:01\n", map[string]any{
+			"url": "https://h:443/p", "time": "10:12:01",
+		}},
+		{"quoted keys", "\"a b\": 1\n'c:d': 2\n", map[string]any{"a b": "1", "c:d": "2"}},
+		{"comments", "# head\na: b # tail\nc: d#not\n  # indented\ne: 'f # g'\n", map[string]any{
+			"a": "b", "c": "d#not", "e": "f # g",
+		}},
+		{"nested mapping", "a:\n  b:\n    c: d\n  e: f\n", map[string]any{
+			"a": map[string]any{"b": map[string]any{"c": "d"}, "e": "f"},
+		}},
+		{"empty value", "a:\nb: c\n", map[string]any{"a": nil, "b": "c"}},
+		{"sequence at key indent", "l:\n- x\n- y\nk: v\n", map[string]any{"l": []any{"x", "y"}, "k": "v"}},
+		{"indented sequence", "l:\n  - x\n  - y\n", map[string]any{"l": []any{"x", "y"}}},
+		{"name lists", "items:\n- name: a\n  item:\n    k: v\n- name: b\n", map[string]any{
+			"items": []any{
+				map[string]any{"name": "a", "item": map[string]any{"k": "v"}},
+				map[string]any{"name": "b"},
+			},
+		}},
+		{"dash on its own line", "l:\n-\n  a: b\n", map[string]any{"l": []any{map[string]any{"a": "b"}}}},
+		{"top-level sequence", "- a\n- b: c\n", []any{"a", map[string]any{"b": "c"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %#v\nwant %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLRejects(t *testing.T) {
+	tests := []struct{ name, src string }{
+		{"tab indent", "a:\n\tb: c\n"},
+		{"anchor", "a: &x b\n"},
+		{"alias", "a: *x\n"},
+		{"flow mapping", "a: {b: c}\n"},
+		{"flow sequence", "a: [b, c]\n"},
+		{"block scalar", "a: |\n  text\n"},
+		{"folded scalar", "a: >\n  text\n"},
+		{"tag", "a: !!str b\n"},
+		{"bad indentation", "a: b\n  c: d\n"},
+		{"dedent mismatch", "a:\n    b: c\n  d: e\n"},
+		{"not a key", "a: b\njust text\n"},
+		{"unterminated quote", "a: \"b\n"},
+		{"unterminated single quote", "a: 'b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v, err := parseYAML(tt.src); err == nil {
+				t.Errorf("accepted as %#v", v)
+			}
+		})
+	}
+}
+
+func TestSplitYAMLKey(t *testing.T) {
+	tests := []struct {
+		text     string
+		key, val string
+		ok       bool
+	}{
+		{"a: b", "a", "b", true},
+		{"a:", "a", "", true},
+		{"a:  b c ", "a", "b c", true},
+		{"server: https://h:6443", "server", "https://h:6443", true},
+		{"a:b", "", "", false},
+		{"plain", "", "", false},
+		{`"quoted key": v`, "quoted key", "v", true},
+		{`"a: b": c`, "a: b", "c", true},
+		{`'it''s': v`, "", "", false}, // doubled quotes in keys are not handled
+		{`'k':`, "k", "", true},
+		{`"k"x: v`, "", "", false},
+		{`"k":v`, "", "", false},
+		{`"unterminated: v`, "", "", false},
+	}
+	for _, tt := range tests {
+		key, val, ok := splitYAMLKey(tt.text)
+		if key != tt.key || val != tt.val || ok != tt.ok {
+			t.Errorf("splitYAMLKey(%q) = %q, %q, %t; want %q, %q, %t", tt.text, key, val, ok, tt.key, tt.val, tt.ok)
+		}
+	}
+}
+
+func TestStripYAMLComment(t *testing.T) {
+	tests := []struct{ line, want string }{
+		{"a: b", "a: b"},
+		{"# all comment", ""},
+		{"a: b # note", "a: b "},
+		{"a: b\t# note", "a: b\t"},
+		{"a: b#c", "a: b#c"},
+		{"url: http://h/#frag", "url: http://h/#frag"},
+		{`a: "b # c"`, `a: "b # c"`},
+		{`a: "b \" # c" # d`, `a: "b \" # c" `},
+		{`a: 'b # c' # d`, `a: 'b # c' `},
+		{`a: 'it''s # x'`, `a: 'it''s # x'`},
+		{`- "x # y"`, `- "x # y"`},
+		{`a: don't # c`, `a: don't `},
+	}
+	for _, tt := range tests {
+		if got := stripYAMLComment(tt.line); got != tt.want {
+			t.Errorf("stripYAMLComment(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -17,15 +21,32 @@ import (
 
 var (
 	rdb           *RedisClient
+	blobStore     BlobStore
+	blobCfg       BlobConfig
 	k8s           *K8sClient
 	maxUploadSize int64 = 10 << 20
+
+	// imageCacheControl is sent with every image. The same URL can serve
+	// new bytes after an effect or re-upload, so the default makes browsers
+	// revalidate each time, which the ETag turns into a cheap 304.
+	imageCacheControl = "public, no-cache"
 )
 
 type Post struct {
-	ID        string `json:"id"`
-	Title     string `json:"title"`
-	Body      string `json:"body"`
-	CreatedAt int64  `json:"created_at"`
+	ID        string       `json:"id"`
+	Title     string       `json:"title"`
+	Body      string       `json:"body"`
+	CreatedAt int64        `json:"created_at"`
+	UpdatedAt int64        `json:"updated_at,omitempty"`
+	Cover     string       `json:"cover,omitempty"`  // image ID of Image
+	Image     *postImage   `json:"image,omitempty"`  // the cover image
+	Images    []*postImage `json:"images,omitempty"` // the gallery, in order; GET /posts/{id} only
+}
+
+func postFromHash(id string, m map[string]string) Post {
+	created, _ := strconv.ParseInt(m["created_at"], 10, 64)
+	updated, _ := strconv.ParseInt(m["updated_at"], 10, 64)
+	return Post{ID: id, Title: m["title"], Body: m["body"], CreatedAt: created, UpdatedAt: updated, Cover: m["cover"]}
 }
 
 func main() {
@@ -37,14 +58,42 @@ func main() {
 		}
 	}
 
-	rdb = NewRedisClient(redisAddr)
+	stripMetadata = getenvBool("UPLOAD_STRIP_METADATA", stripMetadata)
+	autoOrient = getenvBool("UPLOAD_AUTO_ORIENT", autoOrient)
+	if ws, err := parseWidths(getenv("THUMB_WIDTHS", formatWidths(thumbWidths))); err != nil {
+		log.Printf("[env] THUMB_WIDTHS invalid (%v), using default", err)
+	} else {
+		thumbWidths = ws
+	}
+	maxImagePixels = getenvInt("MAX_IMAGE_PIXELS", maxImagePixels)
+	imageCacheControl = cacheControl(getenvDuration("IMAGE_CACHE_MAX_AGE", 0))
+	uploadSessionTTL = getenvDuration("UPLOAD_SESSION_TTL", uploadSessionTTL)
+	uploadSpoolDir = getenv("UPLOAD_SPOOL_DIR", os.TempDir())
+	setUploadConcurrency(getenvInt("MAX_CONCURRENT_UPLOADS", 4))
+
+	poolOpts := PoolOptions{
+		MinIdle:     getenvInt("REDIS_POOL_MIN_IDLE", 2),
+		MaxOpen:     getenvInt("REDIS_POOL_MAX_OPEN", 16),
+		IdleTimeout: getenvDuration("REDIS_POOL_IDLE_TIMEOUT", 5*time.Minute),
+		HealthCheck: getenvDuration("REDIS_POOL_HEALTH_CHECK", 30*time.Second),
+	}
+	rdb = NewRedisClient(redisAddr, poolOpts)
 	defer rdb.Close()
 
-	if kc, err := NewInClusterK8sClient(); err != nil {
-		log.Printf("[k8s] in-cluster client not available: %v", err)
+	blobCfg = blobConfigFromEnv()
+	bs, err := NewBlobStore(blobCfg, rdb)
+	if err != nil {
+		log.Fatalf("[startup] blob store: %v", err)
+	}
+	blobStore = bs
+
+	if kc, source, err := NewK8sClient(); err != nil {
+		log.Printf("[k8s] client not available: %v", err)
 	} else {
 		k8s = kc
-		log.Printf("[k8s] in-cluster client ready (ns=%s)", k8s.namespace)
+		log.Printf("[k8s] %s client ready (server=%s, ns=%s)", source, k8s.baseURL, k8s.namespace)
+		go k8s.WatchJobs(context.Background())
+		go k8s.RefreshCredentials(context.Background(), getenvDuration("K8S_CREDENTIALS_RELOAD", time.Minute))
 	}
 
 	mux := http.NewServeMux()
@@ -52,8 +101,11 @@ func main() {
 	mux.HandleFunc("/posts", logRequests(withCORS(postsHandler)))
 	mux.HandleFunc("/posts/", logRequests(withCORS(postByIDHandler)))
 	mux.HandleFunc("/images/", logRequests(withCORS(imagesHandler)))
+	mux.HandleFunc("/uploads", logRequests(withCORS(withTus(uploadsHandler))))
+	mux.HandleFunc("/uploads/", logRequests(withCORS(withTus(uploadsHandler))))
 	mux.HandleFunc("/jobs/effect", logRequests(withCORS(createEffectJobHandler)))
-	mux.HandleFunc("/jobs/", logRequests(withCORS(jobStatusHandler)))
+	mux.HandleFunc("/jobs", logRequests(withCORS(jobsListHandler)))
+	mux.HandleFunc("/jobs/", logRequests(withCORS(jobHandler)))
 
 	srv := &http.Server{
 		Addr:              ":" + port,
@@ -61,7 +113,7 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	log.Printf("[startup] API listening on :%s (redis=%s, maxUploadMiB=%d, reconnect=on)", port, redisAddr, maxUploadSize>>20)
+	log.Printf("[startup] API listening on :%s (redis=%s, blobs=%s, maxUploadMiB=%d, pool=%d..%d)", port, redisAddr, blobCfg.Backend, maxUploadSize>>20, poolOpts.MinIdle, poolOpts.MaxOpen)
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("[server] fatal error: %v", err)
 	}
@@ -125,156 +177,490 @@ func handleCreatePost(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, Post{ID: id, Title: req.Title, Body: req.Body, CreatedAt: ts})
 }
 
+type postPage struct {
+	Posts      []Post `json:"posts"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Limit      int    `json:"limit"`
+}
+
 func handleListPosts(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	limit := 20
-	if s := r.URL.Query().Get("limit"); s != "" {
-		if n, err := strconv.Atoi(s); err == nil && n > 0 {
-			limit = n
+	q := r.URL.Query()
+	limit := pageSize(q)
+	var cursor *pageCursor
+	if s := q.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid cursor")
+			return
 		}
+		cursor = &c
 	}
-	ids, err := rdb.ZRevRange(ctx, "posts:all", 0, int64(limit-1))
+	members, next, err := zPage(ctx, "posts:all", cursor, limit)
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, "zrevrange failed")
+		httpError(w, http.StatusInternalServerError, "zrevrangebyscore failed")
 		return
 	}
-	out := make([]Post, 0, len(ids))
-	for _, idStr := range ids {
-		m, err := rdb.HGetAll(ctx, "post:"+idStr)
+	pipe := rdb.Pipeline()
+	for _, z := range members {
+		pipe.Do("HGETALL", "post:"+z.Member)
+	}
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "hgetall failed")
+		return
+	}
+	out := make([]Post, 0, len(members))
+	for i, z := range members {
+		m, err := parseHash(replies[i])
 		if err != nil || len(m) == 0 {
 			continue
 		}
-		ts, _ := strconv.ParseInt(m["created_at"], 10, 64)
-		out = append(out, Post{ID: idStr, Title: m["title"], Body: m["body"], CreatedAt: ts})
+		out = append(out, postFromHash(z.Member, m))
+	}
+	if err := attachImages(ctx, out, false); err != nil {
+		log.Printf("[post] list images: %v", err)
 	}
-	log.Printf("[post] listed %d items", len(out))
-	writeJSON(w, http.StatusOK, out)
+	if next != "" {
+		u := url.URL{Path: r.URL.Path, RawQuery: url.Values{
+			"cursor": {next},
+			"limit":  {strconv.Itoa(limit)},
+		}.Encode()}
+		w.Header().Set("Link", "<"+u.String()+">; rel=\"next\"")
+	}
+	log.Printf("[post] listed %d items (more=%t)", len(out), next != "")
+	writeJSON(w, http.StatusOK, postPage{Posts: out, NextCursor: next, Limit: limit})
 }
 
 var idRe = regexp.MustCompile(`^[A-Za-z0-9]{12}$`)
 
 func postByIDHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.NotFound(w, r)
-		return
-	}
-	ctx := r.Context()
-	id := strings.TrimPrefix(r.URL.Path, "/posts/")
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/posts/"), "/")
 	if !idRe.MatchString(id) {
 		httpError(w, http.StatusBadRequest, "invalid id")
 		return
 	}
-	m, err := rdb.HGetAll(ctx, "post:"+id)
+	if sub == "jobs" {
+		handlePostJobs(w, r, id)
+		return
+	}
+	if sub != "" {
+		postImagesHandler(w, r, id, sub)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		handleGetPost(w, r, id)
+	case http.MethodPatch, http.MethodPut:
+		handleUpdatePost(w, r, id)
+	case http.MethodDelete:
+		handleDeletePost(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleGetPost(w http.ResponseWriter, r *http.Request, id string) {
+	m, err := rdb.HGetAll(r.Context(), "post:"+id)
 	if err != nil || len(m) == 0 {
 		httpError(w, http.StatusNotFound, "post not found")
 		return
 	}
-	ts, _ := strconv.ParseInt(m["created_at"], 10, 64)
+	posts := []Post{postFromHash(id, m)}
+	if err := attachImages(r.Context(), posts, true); err != nil {
+		log.Printf("[post] get id=%s images: %v", id, err)
+	}
+	p := posts[0]
 	log.Printf("[post] get id=%s", id)
-	writeJSON(w, http.StatusOK, Post{ID: id, Title: m["title"], Body: m["body"], CreatedAt: ts})
+	writeJSON(w, http.StatusOK, p)
+}
+
+type updatePostReq struct {
+	Title *string `json:"title"`
+	Body  *string `json:"body"`
+}
+
+func handleUpdatePost(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	var req updatePostReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if r.Method == http.MethodPut && (req.Title == nil || req.Body == nil) {
+		httpError(w, http.StatusBadRequest, "title and body required")
+		return
+	}
+	if req.Title == nil && req.Body == nil {
+		httpError(w, http.StatusBadRequest, "title or body required")
+		return
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	fields := map[string]string{"updated_at": ts}
+	if req.Title != nil {
+		t := strings.TrimSpace(*req.Title)
+		if t == "" {
+			httpError(w, http.StatusBadRequest, "title must not be empty")
+			return
+		}
+		fields["title"] = t
+	}
+	if req.Body != nil {
+		b := strings.TrimSpace(*req.Body)
+		if b == "" {
+			httpError(w, http.StatusBadRequest, "body must not be empty")
+			return
+		}
+		fields["body"] = b
+	}
+
+	m, err := updatePost(ctx, id, fields, nil, nil)
+	if errors.Is(err, errPostNotFound) {
+		httpError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "hset failed")
+		return
+	}
+	log.Printf("[post] updated id=%s", id)
+	writeJSON(w, http.StatusOK, postFromHash(id, m))
+}
+
+var errPostNotFound = errors.New("post not found")
+
+// updatePost sets fields on the hash of post id and returns the updated
+// hash. The write is a transaction watching the post and keys, and only
+// goes through while the post exists, so a racing delete cannot leave a
+// partial hash behind; check, if set, runs inside it before the write.
+func updatePost(ctx context.Context, id string, fields map[string]string, keys []string, check func(tx *Tx) error) (map[string]string, error) {
+	key := "post:" + id
+	var m map[string]string
+	_, err := watchRetry(ctx, append([]string{key}, keys...), func(tx *Tx) ([][]any, error) {
+		v, err := tx.Do("HGETALL", key)
+		if err != nil {
+			return nil, err
+		}
+		if m, err = parseHash(v); err != nil {
+			return nil, err
+		}
+		if len(m) == 0 {
+			return nil, errPostNotFound
+		}
+		if check != nil {
+			if err := check(tx); err != nil {
+				return nil, err
+			}
+		}
+		cmd := []any{"HSET", key}
+		for k, v := range fields {
+			cmd = append(cmd, k, v)
+			m[k] = v
+		}
+		return [][]any{cmd}, nil
+	})
+	return m, err
+}
+
+// watchRetry runs rdb.Watch, retrying a few times when the transaction
+// loses a race. ErrTxAborted is returned once the retries are used up.
+func watchRetry(ctx context.Context, keys []string, fn func(tx *Tx) ([][]any, error)) ([]any, error) {
+	for attempt := 1; ; attempt++ {
+		replies, err := rdb.Watch(ctx, keys, fn)
+		if !errors.Is(err, ErrTxAborted) || attempt == 3 {
+			return replies, err
+		}
+	}
+}
+
+func handleDeletePost(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	// The gallery is read and deleted in one watched transaction, so an
+	// image added meanwhile is deleted too rather than left behind.
+	var deleteBlobs func() error
+	_, err := watchGallery(ctx, id, func(tx *Tx, g gallery) ([][]any, error) {
+		delImages, del, err := deleteGallery(ctx, id, g.IDs)
+		if err != nil {
+			return nil, err
+		}
+		deleteBlobs = del
+		return [][]any{
+			{"DEL", "post:" + id},
+			{"ZREM", "posts:all", id},
+			delImages,
+		}, nil
+	})
+	if errors.Is(err, errPostNotFound) {
+		httpError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	if errors.Is(err, ErrTxAborted) {
+		httpError(w, http.StatusConflict, "post changed during delete, retry")
+		return
+	}
+	if err != nil {
+		log.Printf("[post] delete id=%s error: %v", id, err)
+		httpError(w, http.StatusInternalServerError, "delete failed")
+		return
+	}
+	if err := deleteBlobs(); err != nil {
+		log.Printf("[post] delete id=%s image blobs: %v", id, err)
+	}
+	log.Printf("[post] deleted id=%s", id)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func imagesHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodPost:
-		if err := handleUploadImage(w, r); err != nil {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/images/"), "/")
+	if !idRe.MatchString(id) {
+		httpError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodPost:
+		if err := handleUploadImage(w, r, id); err != nil {
 			log.Printf("[image] upload error: %v", err)
 		}
-	case http.MethodGet:
-		handleGetImage(w, r)
+	case sub == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		handleGetImage(w, r, id)
+	case sub == "variants" && r.Method == http.MethodGet:
+		handleListVariants(w, r, id)
+	case sub == "revert" && r.Method == http.MethodPost:
+		handleRevertImage(w, r, id)
 	default:
 		http.NotFound(w, r)
 	}
 }
 
-func handleUploadImage(w http.ResponseWriter, r *http.Request) error {
+// handleUploadImage replaces the bytes of an existing image. Given the ID
+// of a post without a gallery, it stores that post's single image under
+// the post ID, as before galleries; POST /posts/{id}/images adds one.
+func handleUploadImage(w http.ResponseWriter, r *http.Request, id string) error {
 	ctx := r.Context()
-	id := strings.TrimPrefix(r.URL.Path, "/images/")
-	if !idRe.MatchString(id) {
-		httpError(w, http.StatusBadRequest, "invalid post id")
+	owner, err := imageOwner(ctx, id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return err
+	}
+	if owner == "" {
+		httpError(w, http.StatusNotFound, "image not found")
 		return nil
 	}
+	release, ok := acquireUploadSlot(w)
+	if !ok {
+		return errUploadsBusy
+	}
+	defer release()
+	sp, name, err := readUpload(w, r)
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+	n, ctype, err := ingestImage(ctx, w, id, sp)
+	if err != nil {
+		return err
+	}
+	if err := addGalleryImage(ctx, owner, id); err != nil {
+		writeAddImageError(ctx, w, id, err)
+		return err
+	}
+	log.Printf("[image] uploaded id=%s post=%s name=%q bytes=%d ctype=%s", id, owner, name, n, ctype)
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true, "bytes": n})
+	return nil
+}
 
+// readUpload spools the image in a request body, either raw or as the
+// "file" field of a multipart form, and returns it with the client's file
+// name if there was one. On failure the error response has already been
+// written.
+func readUpload(w http.ResponseWriter, r *http.Request) (*spooledUpload, string, error) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
-	ct := r.Header.Get("Content-Type")
-	mediaType, _, _ := mime.ParseMediaType(ct)
-
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	src, name := io.Reader(r.Body), ""
 	if strings.HasPrefix(mediaType, "multipart/") {
-		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-			httpError(w, http.StatusRequestEntityTooLarge, "file too large")
-			return err
-		}
-		file, header, err := r.FormFile("file")
+		part, err := filePart(r)
 		if err != nil {
 			httpError(w, http.StatusBadRequest, "missing file")
-			return err
+			return nil, "", err
 		}
-		defer file.Close()
-		data, err := io.ReadAll(file)
+		defer part.Close()
+		src, name = part, part.FileName()
+	}
+	sp, err := spoolUpload(src, maxUploadSize)
+	if err != nil {
+		writeSpoolError(w, err)
+		return nil, "", err
+	}
+	return sp, name, nil
+}
+
+// filePart streams the multipart body up to its "file" part. Parts before
+// it are skipped without being buffered.
+func filePart(r *http.Request) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
 		if err != nil {
-			httpError(w, http.StatusBadRequest, "read failed")
-			return err
+			return nil, err
 		}
-		ctype := header.Header.Get("Content-Type")
-		if ctype == "" {
-			ctype = sniffContentType(header.Filename, data)
+		if part.FormName() == "file" {
+			return part, nil
 		}
-		if err := saveImage(ctx, id, data, ctype); err != nil {
-			httpError(w, http.StatusInternalServerError, "save failed")
-			return err
-		}
-		log.Printf("[image] uploaded id=%s bytes=%d ctype=%s", id, len(data), ctype)
-		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "bytes": len(data)})
-		return nil
+		part.Close()
 	}
+}
 
-	data, err := io.ReadAll(io.LimitReader(r.Body, maxUploadSize+1))
+// ingestImage runs a spooled upload through applyUploadPolicy and stores
+// it as image id, returning the stored size and content type.
+// On failure the error response has already been written.
+func ingestImage(ctx context.Context, w http.ResponseWriter, id string, sp *spooledUpload) (int64, string, error) {
+	out, ctype, sizes, err := applyUploadPolicy(w, id, sp)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, "read failed")
-		return err
-	}
-	if int64(len(data)) > maxUploadSize {
-		httpError(w, http.StatusRequestEntityTooLarge, "file too large")
-		return fmt.Errorf("file too large")
+		return 0, "", err
 	}
-	ctype := r.Header.Get("Content-Type")
-	if ctype == "" {
-		ctype = "application/octet-stream"
+	if out != sp {
+		defer out.Close()
 	}
-	if err := saveImage(ctx, id, data, ctype); err != nil {
+	if err := saveImage(ctx, id, out, ctype, sizes); err != nil {
 		httpError(w, http.StatusInternalServerError, "save failed")
-		return err
+		return 0, "", err
 	}
-	log.Printf("[image] uploaded raw id=%s bytes=%d ctype=%s", id, len(data), ctype)
-	writeJSON(w, http.StatusOK, map[string]any{"ok": true, "bytes": len(data)})
-	return nil
+	return out.size, ctype, nil
 }
 
-func handleGetImage(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	id := strings.TrimPrefix(r.URL.Path, "/images/")
-	if !idRe.MatchString(id) {
-		httpError(w, http.StatusBadRequest, "invalid id")
+// applyUploadPolicy validates an upload, runs prepareUpload and renders
+// the thumbnails. It answers 415 for anything that is not an accepted image
+// and returns the content type detected from the data; the client's
+// Content-Type is never trusted. The upload to store is sp itself unless
+// the policy rewrote it.
+func applyUploadPolicy(w http.ResponseWriter, id string, sp *spooledUpload) (*spooledUpload, string, *renditions, error) {
+	ctype, img, err := validateImage(sp.Reader())
+	if err != nil {
+		httpError(w, http.StatusUnsupportedMediaType, err.Error())
+		return nil, "", nil, err
+	}
+	out, meta, err := prepareUpload(sp)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid image")
+		return nil, "", nil, err
+	}
+	if meta.Orientation > 1 || len(meta.Stripped) > 0 {
+		log.Printf("[image] metadata id=%s orientation=%d oriented=%t stripped=%v", id, meta.Orientation, meta.Oriented, meta.Stripped)
+	}
+	// img was decoded before prepareUpload, so it still needs orienting
+	// even when the stored file was rotated.
+	sizes, err := makeThumbnails(img, ctype, meta.Orientation)
+	if err != nil {
+		log.Printf("[image] no thumbnails id=%s: %v", id, err)
+		return out, ctype, nil, nil
+	}
+	return out, ctype, sizes, nil
+}
+
+func handleGetImage(w http.ResponseWriter, r *http.Request, id string) {
+	q := r.URL.Query()
+	variant := strings.ToLower(q.Get("variant"))
+	if variant != "" && !variantRe.MatchString(variant) {
+		httpError(w, http.StatusBadRequest, "invalid variant")
+		return
+	}
+	width := 0
+	if s := q.Get("w"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid width")
+			return
+		}
+		width = n
+	}
+	img, err := loadImage(r.Context(), id, variant, width)
+	if err != nil {
+		httpError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	h := w.Header()
+	h.Set("ETag", img.info.ETag)
+	h.Set("Cache-Control", imageCacheControl)
+	if img.info.notModified(r) {
+		// Answered from the validators, without fetching the blob.
+		if !img.info.Modified.IsZero() {
+			h.Set("Last-Modified", img.info.Modified.UTC().Format(http.TimeFormat))
+		}
+		log.Printf("[image] not modified id=%s variant=%s w=%d", id, variant, width)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err := img.load(r.Context()); err != nil {
+		httpError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	log.Printf("[image] serve id=%s variant=%s w=%d bytes=%d", id, variant, width, len(img.data))
+	h.Set("Content-Type", img.ctype)
+	h.Set("X-Content-Type-Options", "nosniff")
+	// ServeContent handles Range, If-Range and the remaining preconditions,
+	// using the ETag set above.
+	http.ServeContent(w, r, "", img.info.Modified, bytes.NewReader(img.data))
+}
+
+func cacheControl(maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return "public, no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
+
+func handleListVariants(w http.ResponseWriter, r *http.Request, id string) {
+	active, names, err := listVariants(r.Context(), id)
+	if errors.Is(err, ErrNil) {
+		httpError(w, http.StatusNotFound, "image not found")
 		return
 	}
-	data, ctype, err := loadImage(ctx, id)
 	if err != nil {
+		httpError(w, http.StatusInternalServerError, "list variants failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":       id,
+		"active":   active,
+		"variants": names,
+	})
+}
+
+func handleRevertImage(w http.ResponseWriter, r *http.Request, id string) {
+	err := revertImage(r.Context(), id)
+	if errors.Is(err, ErrNil) {
 		httpError(w, http.StatusNotFound, "image not found")
 		return
 	}
-	log.Printf("[image] serve id=%s bytes=%d", id, len(data))
-	w.Header().Set("Content-Type", ctype)
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "revert failed")
+		return
+	}
+	log.Printf("[image] reverted id=%s to original", id)
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true, "active": originalVariant})
 }
 
+// effectJobReq accepts either a single effect or an ordered pipeline.
+// Effect and Params are shorthand for a one-step pipeline.
 type effectJobReq struct {
-	PostID string `json:"post_id"`
-	Effect string `json:"effect"`
+	PostID   string         `json:"post_id"`
+	ImageID  string         `json:"image_id,omitempty"` // default: the post's cover image
+	Effect   string         `json:"effect,omitempty"`
+	Params   map[string]any `json:"params,omitempty"`
+	Pipeline []effectOp     `json:"pipeline,omitempty"`
+	Variant  string         `json:"variant,omitempty"`
+	Format   string         `json:"format,omitempty"`  // png, jpeg or gif; default keeps the source format
+	Quality  int            `json:"quality,omitempty"` // JPEG quality 1-100
 }
 
 type effectJobResp struct {
 	JobName string `json:"job_name"`
+	ImageID string `json:"image_id"`
+	Variant string `json:"variant"`
 }
 
 func createEffectJobHandler(w http.ResponseWriter, r *http.Request) {
@@ -293,76 +679,94 @@ func createEffectJobHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.PostID = strings.TrimSpace(req.PostID)
-	req.Effect = strings.ToLower(strings.TrimSpace(req.Effect))
 	if !idRe.MatchString(req.PostID) {
 		httpError(w, http.StatusBadRequest, "invalid post_id")
 		return
 	}
-	if req.Effect != "grayscale" && req.Effect != "invert" {
-		httpError(w, http.StatusBadRequest, "effect must be grayscale or invert")
+	if req.Effect != "" {
+		if len(req.Pipeline) > 0 {
+			httpError(w, http.StatusBadRequest, "use either effect or pipeline, not both")
+			return
+		}
+		req.Pipeline = []effectOp{{Op: req.Effect, Params: req.Params}}
+	} else if len(req.Params) > 0 {
+		httpError(w, http.StatusBadRequest, "params require effect; use pipeline[].params instead")
 		return
 	}
-
-	jobImage := getenv("JOB_IMAGE", "image-job:0.1")
-	redisAddr := getenv("REDIS_ADDR", "redis:6379")
-
-	jobName, err := k8s.CreateImageEffectJob(r.Context(), jobImage, redisAddr, req.PostID, req.Effect)
+	if len(req.Pipeline) == 0 {
+		httpError(w, http.StatusBadRequest, "effect or pipeline required")
+		return
+	}
+	if len(req.Pipeline) > maxPipelineOps {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("pipeline may have at most %d steps", maxPipelineOps))
+		return
+	}
+	for i := range req.Pipeline {
+		if err := normalizeOp(&req.Pipeline[i]); err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("pipeline[%d]: %v", i, err))
+			return
+		}
+	}
+	spec, err := json.Marshal(req.Pipeline)
 	if err != nil {
-		log.Printf("[k8s] create job error: %v", err)
-		httpError(w, http.StatusInternalServerError, "failed to create job")
+		httpError(w, http.StatusInternalServerError, "encode pipeline failed")
+		return
+	}
+	req.Variant = strings.ToLower(strings.TrimSpace(req.Variant))
+	if req.Variant == "" {
+		req.Variant = pipelineVariant(req.Pipeline, spec)
+	}
+	if req.Variant == originalVariant || !variantRe.MatchString(req.Variant) {
+		httpError(w, http.StatusBadRequest, "invalid variant")
 		return
 	}
-	writeJSON(w, http.StatusAccepted, effectJobResp{JobName: jobName})
-}
 
-func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.NotFound(w, r)
+	req.Format = strings.ToLower(strings.TrimSpace(req.Format))
+	if req.Format == "jpg" {
+		req.Format = "jpeg"
+	}
+	if req.Format != "" && req.Format != "png" && req.Format != "jpeg" && req.Format != "gif" {
+		httpError(w, http.StatusBadRequest, "format must be png, jpeg or gif")
 		return
 	}
-	if k8s == nil {
-		httpError(w, http.StatusServiceUnavailable, "kubernetes not available in this environment")
+	if req.Quality < 0 || req.Quality > 100 {
+		httpError(w, http.StatusBadRequest, "quality must be between 1 and 100")
 		return
 	}
-	p := strings.TrimPrefix(r.URL.Path, "/jobs/")
-	parts := strings.SplitN(p, "/", 2)
-	if len(parts) != 2 || parts[1] != "status" || parts[0] == "" {
-		http.NotFound(w, r)
+	if req.ImageID != "" && !idRe.MatchString(req.ImageID) {
+		httpError(w, http.StatusBadRequest, "invalid image_id")
 		return
 	}
-	name := parts[0]
-	st, reason, err := k8s.JobStatus(r.Context(), name)
+	imageID, err := effectTarget(r.Context(), req.PostID, req.ImageID)
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, "status error")
+		httpError(w, http.StatusInternalServerError, "gallery lookup failed")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{
-		"status": st,
-		"reason": reason,
-		"name":   name,
-	})
-}
-
-func saveImage(ctx context.Context, id string, data []byte, ctype string) error {
-	if err := rdb.Set(ctx, "image:"+id, data, 0); err != nil {
-		return err
-	}
-	if ctype == "" {
-		ctype = "application/octet-stream"
+	if imageID == "" {
+		httpError(w, http.StatusNotFound, "image not found")
+		return
 	}
-	return rdb.Set(ctx, "image:ctype:"+id, []byte(ctype), 0)
-}
 
-func loadImage(ctx context.Context, id string) ([]byte, string, error) {
-	data, err := rdb.GetBytes(ctx, "image:"+id)
-	if err != nil {
-		return nil, "", err
+	job := ImageEffectJob{
+		Image:     getenv("JOB_IMAGE", "image-job:0.1"),
+		RedisAddr: getenv("REDIS_ADDR", "redis:6379"),
+		PostID:    req.PostID,
+		ImageID:   imageID,
+		Variant:   req.Variant,
+		Pipeline:  spec,
+		Format:    req.Format,
+		Quality:   req.Quality,
+		Thumbs:    formatWidths(thumbWidths),
+		Blob:      blobCfg,
 	}
-	ctype, err := rdb.GetString(ctx, "image:ctype:"+id)
-	if err != nil || ctype == "" {
-		ctype = "application/octet-stream"
+	jobName, err := k8s.CreateImageEffectJob(r.Context(), job)
+	if err != nil {
+		log.Printf("[k8s] create job error: %v", err)
+		httpError(w, http.StatusInternalServerError, "failed to create job")
+		return
 	}
-	return data, ctype, nil
+	log.Printf("[k8s] job %s: post=%s image=%s variant=%s pipeline=%s", jobName, req.PostID, imageID, req.Variant, spec)
+	writeJSON(w, http.StatusAccepted, effectJobResp{JobName: jobName, ImageID: imageID, Variant: req.Variant})
 }
 
 func generateUniqueID(ctx context.Context, n int) (string, error) {
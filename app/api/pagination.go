@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageCursor marks the last item returned on a page. Items sharing the same
+// score are ordered by member descending, which ZREVRANGEBYSCORE guarantees.
+type pageCursor struct {
+	Score float64
+	ID    string
+}
+
+// encodeCursor renders c as an opaque URL-safe token.
+func encodeCursor(c pageCursor) string {
+	raw := formatFloat(c.Score) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses a token produced by encodeCursor.
+func decodeCursor(s string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("cursor: %w", err)
+	}
+	score, id, ok := strings.Cut(string(b), ":")
+	if !ok || !idRe.MatchString(id) {
+		return pageCursor{}, fmt.Errorf("cursor: malformed")
+	}
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("cursor: %w", err)
+	}
+	return pageCursor{Score: f, ID: id}, nil
+}
+
+// pageSize parses the limit query value, clamped to [1, maxPageSize].
+func pageSize(q url.Values) int {
+	n, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || n <= 0 {
+		return defaultPageSize
+	}
+	return min(n, maxPageSize)
+}
+
+// zPage returns up to limit members of the sorted set key that come after
+// cursor (or from the top when cursor is nil), plus the cursor for the next
+// page, which is empty when there are no more items.
+func zPage(ctx context.Context, key string, cursor *pageCursor, limit int) ([]ZMember, string, error) {
+	var out []ZMember
+	upper := "+inf"
+	if cursor != nil {
+		// Members that tie with the cursor's score but sort after its ID.
+		s := formatFloat(cursor.Score)
+		ties, err := rdb.ZRevRangeByScore(ctx, key, s, s, 0, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, z := range ties {
+			if z.Member < cursor.ID {
+				out = append(out, z)
+			}
+		}
+		upper = "(" + s
+	}
+	if len(out) <= limit {
+		rest, err := rdb.ZRevRangeByScore(ctx, key, upper, "-inf", 0, int64(limit+1-len(out)))
+		if err != nil {
+			return nil, "", err
+		}
+		out = append(out, rest...)
+	}
+	if len(out) <= limit {
+		return out, "", nil
+	}
+	out = out[:limit]
+	last := out[len(out)-1]
+	return out, encodeCursor(pageCursor{Score: last.Score, ID: last.Member}), nil
+}
@@ -9,30 +9,54 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 )
 
 var ErrNil = errors.New("redis: nil")
 
+// RedisError is an error reply sent by the server (a "-" RESP line).
+type RedisError string
+
+func (e RedisError) Error() string { return string(e) }
+
 type RedisClient struct {
-	mu   sync.Mutex
-	addr string
-	conn net.Conn
-	rw   *bufio.ReadWriter
+	pool *connPool
 }
 
-func NewRedisClient(addr string) *RedisClient {
-	return &RedisClient{addr: addr}
+func NewRedisClient(addr string, opts PoolOptions) *RedisClient {
+	return &RedisClient{pool: newConnPool(addr, opts)}
 }
 
 func (c *RedisClient) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.conn != nil {
-		return c.conn.Close()
-	}
-	return nil
+	return c.pool.close()
+}
+
+// Pipeline queues commands to be sent in a single write/read cycle.
+type Pipeline struct {
+	c    *RedisClient
+	cmds [][]any
+}
+
+func (c *RedisClient) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do queues cmd and returns its index in the slice returned by Exec.
+func (p *Pipeline) Do(cmd string, args ...any) int {
+	p.cmds = append(p.cmds, append([]any{cmd}, args...))
+	return len(p.cmds) - 1
+}
+
+func (p *Pipeline) Len() int { return len(p.cmds) }
+
+// Exec sends all queued commands and returns one reply per command. A reply
+// that is a server error is returned as a RedisError value.
+func (p *Pipeline) Exec(ctx context.Context) ([]any, error) {
+	if len(p.cmds) == 0 {
+		return nil, nil
+	}
+	cmds := p.cmds
+	p.cmds = nil
+	return p.c.roundTrip(ctx, cmds)
 }
 
 func (c *RedisClient) HSet(ctx context.Context, key string, fields map[string]interface{}) error {
@@ -49,6 +73,14 @@ func (c *RedisClient) HGetAll(ctx context.Context, key string) (map[string]strin
 	if err != nil {
 		return nil, err
 	}
+	return parseHash(v)
+}
+
+// parseHash converts an HGETALL reply into a map.
+func parseHash(v any) (map[string]string, error) {
+	if e, ok := v.(RedisError); ok {
+		return nil, e
+	}
 	arr, ok := v.([]any)
 	if !ok {
 		return nil, fmt.Errorf("HGETALL: unexpected type %T", v)
@@ -93,6 +125,45 @@ func (c *RedisClient) ZRevRange(ctx context.Context, key string, start, stop int
 	return out, nil
 }
 
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ZRevRangeByScore returns members with scores between max and min (Redis
+// range syntax, so "(" prefixes exclusive bounds), highest score first.
+func (c *RedisClient) ZRevRangeByScore(ctx context.Context, key, max, min string, offset, count int64) ([]ZMember, error) {
+	args := []any{key, max, min, "WITHSCORES"}
+	if count > 0 {
+		args = append(args, "LIMIT", strconv.FormatInt(offset, 10), strconv.FormatInt(count, 10))
+	}
+	v, err := c.do(ctx, "ZREVRANGEBYSCORE", args...)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("ZREVRANGEBYSCORE: unexpected type %T", v)
+	}
+	if len(arr)%2 != 0 {
+		return nil, fmt.Errorf("ZREVRANGEBYSCORE: expected even array length, got %d", len(arr))
+	}
+	out := make([]ZMember, 0, len(arr)/2)
+	for i := 0; i < len(arr); i += 2 {
+		mb, ok1 := arr[i].([]byte)
+		sb, ok2 := arr[i+1].([]byte)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("ZREVRANGEBYSCORE: expected bulk strings")
+		}
+		score, err := strconv.ParseFloat(string(sb), 64)
+		if err != nil {
+			return nil, fmt.Errorf("ZREVRANGEBYSCORE: bad score %q: %w", sb, err)
+		}
+		out = append(out, ZMember{Member: string(mb), Score: score})
+	}
+	return out, nil
+}
+
 func (c *RedisClient) Set(ctx context.Context, key string, value []byte, ttlSeconds int) error {
 	args := []any{key, value}
 	if ttlSeconds > 0 {
@@ -125,6 +196,19 @@ func (c *RedisClient) GetString(ctx context.Context, key string) (string, error)
 	return string(b), nil
 }
 
+// GetRange returns bytes start..end (inclusive) of the string at key.
+func (c *RedisClient) GetRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
+	v, err := c.do(ctx, "GETRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(end, 10))
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("GETRANGE: unexpected type %T", v)
+	}
+	return b, nil
+}
+
 func (c *RedisClient) Exists(ctx context.Context, key string) (int64, error) {
 	v, err := c.do(ctx, "EXISTS", key)
 	if err != nil {
@@ -137,85 +221,172 @@ func (c *RedisClient) Exists(ctx context.Context, key string) (int64, error) {
 	return n, nil
 }
 
-func (c *RedisClient) do(ctx context.Context, cmd string, args ...any) (any, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	sendOnce := func() (any, error) {
-		if c.conn == nil {
-			if err := c.connectLocked(ctx); err != nil {
-				return nil, err
-			}
-		}
-		if dl, ok := ctx.Deadline(); ok {
-			_ = c.conn.SetDeadline(dl)
-		} else {
-			_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
-		}
-		defer c.conn.SetDeadline(time.Time{})
-		if err := writeArrayHeader(c.rw, 1+len(args)); err != nil {
-			return nil, err
-		}
-		if err := writeBulk(c.rw, strings.ToUpper(cmd)); err != nil {
-			return nil, err
-		}
-		for _, a := range args {
-			switch v := a.(type) {
-			case []byte:
-				if err := writeBulkBytes(c.rw, v); err != nil {
-					return nil, err
-				}
-			default:
-				if err := writeBulk(c.rw, toString(v)); err != nil {
-					return nil, err
-				}
-			}
-		}
-		if err := c.rw.Flush(); err != nil {
-			return nil, err
+func (c *RedisClient) SMembers(ctx context.Context, key string) ([]string, error) {
+	v, err := c.do(ctx, "SMEMBERS", key)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("SMEMBERS: unexpected type %T", v)
+	}
+	out := make([]string, 0, len(arr))
+	for _, it := range arr {
+		b, ok := it.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("SMEMBERS: expected bulk string, got %T", it)
 		}
-		return readResp(c.rw.Reader)
+		out = append(out, string(b))
 	}
+	return out, nil
+}
+
+func (c *RedisClient) Del(ctx context.Context, keys ...string) (int64, error) {
+	args := make([]any, 0, len(keys))
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	v, err := c.do(ctx, "DEL", args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("DEL: unexpected type %T", v)
+	}
+	return n, nil
+}
+
+// ErrTxAborted is returned when EXEC discards a transaction because a
+// watched key changed.
+var ErrTxAborted = errors.New("transaction aborted")
+
+// Multi runs cmds atomically inside MULTI/EXEC and returns the EXEC replies.
+// A reply that is a server error is returned as a RedisError value.
+func (c *RedisClient) Multi(ctx context.Context, cmds ...[]any) ([]any, error) {
+	replies, err := c.roundTrip(ctx, multiBatch(cmds))
+	if err != nil {
+		return nil, err
+	}
+	return execReplies(replies)
+}
+
+// Tx is the connection handed to a Watch callback. Its reads run after the
+// WATCH, so any change to the watched keys they miss aborts the EXEC.
+type Tx struct {
+	ctx context.Context
+	cn  *redisConn
+}
 
-	v, err := sendOnce()
-	if !isRetryableNetErr(err) {
-		return v, err
+// Do runs one command on the transaction's connection.
+func (tx *Tx) Do(cmd string, args ...any) (any, error) {
+	replies, err := tx.cn.roundTrip(tx.ctx, [][]any{append([]any{cmd}, args...)})
+	if err != nil {
+		return nil, err
 	}
+	if e, ok := replies[0].(RedisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
 
-	_ = c.resetLocked()
-	if recErr := c.connectLocked(ctx); recErr != nil {
-		if err == nil {
-			err = recErr
+// Watch runs an optimistic transaction on one connection: it WATCHes keys,
+// calls fn to read through tx and decide what to write, then runs the
+// returned commands inside MULTI/EXEC. When fn fails or returns no commands
+// nothing is written and fn's error is returned. ErrTxAborted means a
+// watched key changed between the WATCH and the EXEC.
+func (c *RedisClient) Watch(ctx context.Context, keys []string, fn func(tx *Tx) ([][]any, error)) ([]any, error) {
+	cn, _, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	broken := true
+	defer func() { c.pool.put(cn, broken) }()
+
+	tx := &Tx{ctx: ctx, cn: cn}
+	watch := make([]any, len(keys))
+	for i, k := range keys {
+		watch[i] = k
+	}
+	if _, err := tx.Do("WATCH", watch...); err != nil {
+		return nil, err
+	}
+	cmds, err := fn(tx)
+	if err != nil || len(cmds) == 0 {
+		if _, uerr := tx.Do("UNWATCH"); uerr == nil {
+			broken = false
 		}
 		return nil, err
 	}
-	return sendOnce()
+	replies, err := cn.roundTrip(ctx, multiBatch(cmds))
+	if err != nil {
+		return nil, err
+	}
+	broken = false
+	return execReplies(replies)
 }
 
-func (c *RedisClient) connectLocked(ctx context.Context) error {
-	timeout := 5 * time.Second
-	if dl, ok := ctx.Deadline(); ok {
-		if t := time.Until(dl); t > 0 {
-			timeout = t
+func multiBatch(cmds [][]any) [][]any {
+	batch := make([][]any, 0, len(cmds)+2)
+	batch = append(batch, []any{"MULTI"})
+	batch = append(batch, cmds...)
+	return append(batch, []any{"EXEC"})
+}
+
+// execReplies checks the replies to a multiBatch and returns those of EXEC.
+func execReplies(replies []any) ([]any, error) {
+	for _, r := range replies[:len(replies)-1] {
+		if e, ok := r.(RedisError); ok {
+			return nil, fmt.Errorf("MULTI: %w", e)
 		}
 	}
-	d := &net.Dialer{Timeout: timeout}
-	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	switch v := replies[len(replies)-1].(type) {
+	case RedisError:
+		return nil, fmt.Errorf("EXEC: %w", v)
+	case []any:
+		return v, nil
+	case nil:
+		return nil, fmt.Errorf("EXEC: %w", ErrTxAborted)
+	default:
+		return nil, fmt.Errorf("EXEC: unexpected type %T", v)
+	}
+}
+
+func (c *RedisClient) do(ctx context.Context, cmd string, args ...any) (any, error) {
+	replies, err := c.roundTrip(ctx, [][]any{append([]any{cmd}, args...)})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.conn = conn
-	c.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	return nil
+	if e, ok := replies[0].(RedisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
 }
 
-func (c *RedisClient) resetLocked() error {
-	if c.conn != nil {
-		_ = c.conn.Close()
+// roundTrip runs cmds on one pooled connection. A network failure on a
+// reused connection is retried once on a freshly dialed one.
+func (c *RedisClient) roundTrip(ctx context.Context, cmds [][]any) ([]any, error) {
+	cn, fresh, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
 	}
-	c.conn = nil
-	c.rw = nil
-	return nil
+	v, err := cn.roundTrip(ctx, cmds)
+	if err == nil {
+		c.pool.put(cn, false)
+		return v, nil
+	}
+	c.pool.put(cn, true)
+	if fresh || !isRetryableNetErr(err) {
+		return nil, err
+	}
+
+	cn, err = c.pool.dialChecked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err = cn.roundTrip(ctx, cmds)
+	c.pool.put(cn, err != nil)
+	return v, err
 }
 
 func isRetryableNetErr(err error) bool {
@@ -244,6 +415,29 @@ func isRetryableNetErr(err error) bool {
 	return false
 }
 
+func writeCommand(w *bufio.ReadWriter, cmd []any) error {
+	if err := writeArrayHeader(w, len(cmd)); err != nil {
+		return err
+	}
+	for i, a := range cmd {
+		switch v := a.(type) {
+		case []byte:
+			if err := writeBulkBytes(w, v); err != nil {
+				return err
+			}
+		default:
+			s := toString(v)
+			if i == 0 {
+				s = strings.ToUpper(s)
+			}
+			if err := writeBulk(w, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func writeArrayHeader(w *bufio.ReadWriter, n int) error {
 	_, err := w.WriteString("*" + strconv.Itoa(n) + "\r\n")
 	return err
@@ -284,7 +478,7 @@ func readResp(r *bufio.Reader) (any, error) {
 	case '+':
 		return line[1:], nil
 	case '-':
-		return nil, errors.New(line[1:])
+		return nil, RedisError(line[1:])
 	case ':':
 		n, err := strconv.ParseInt(line[1:], 10, 64)
 		if err != nil {
@@ -318,9 +512,17 @@ func readResp(r *bufio.Reader) (any, error) {
 		if n == -1 {
 			return nil, nil
 		}
+		// An element may be an error, such as a command that failed inside
+		// EXEC. It is kept as a RedisError value so the rest of the array
+		// is still read off the connection.
 		arr := make([]any, 0, n)
 		for i := 0; i < n; i++ {
 			v, err := readResp(r)
+			var re RedisError
+			if errors.As(err, &re) {
+				arr = append(arr, re)
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// scriptedRedis is a minimal RESP server: MULTI queues commands, EXEC runs
+// them, INCR always fails with WRONGTYPE, and ECHO, SET and PING answer as
+// Redis does. It counts the connections it accepts.
+type scriptedRedis struct {
+	ln    net.Listener
+	conns atomic.Int32
+}
+
+func newScriptedRedis(t *testing.T) *scriptedRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scriptedRedis{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *scriptedRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queue [][]string
+	inMulti := false
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var out string
+		switch name := strings.ToUpper(cmd[0]); {
+		case name == "MULTI":
+			inMulti, queue = true, nil
+			out = "+OK\r\n"
+		case name == "EXEC":
+			out = fmt.Sprintf("*%d\r\n", len(queue))
+			for _, q := range queue {
+				out += scriptedReply(q)
+			}
+			inMulti, queue = false, nil
+		case inMulti:
+			queue = append(queue, cmd)
+			out = "+QUEUED\r\n"
+		default:
+			out = scriptedReply(cmd)
+		}
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func scriptedReply(cmd []string) string {
+	switch strings.ToUpper(cmd[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		return "+OK\r\n"
+	case "INCR":
+		return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	case "ECHO":
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(cmd[1]), cmd[1])
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(line, "*"))
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		if _, err := readLine(r); err != nil {
+			return nil, err
+		}
+		arg, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = arg
+	}
+	return cmd, nil
+}
+
+// TestMultiErrorElementKeepsConnectionInSync runs a transaction in which
+// one queued command fails, then reuses the same pooled connection. The
+// failed element must not cut the EXEC reply short and leave the rest of
+// it to be read as the reply to the next command.
+func TestMultiErrorElementKeepsConnectionInSync(t *testing.T) {
+	srv := newScriptedRedis(t)
+	c := NewRedisClient(srv.ln.Addr().String(), PoolOptions{MaxOpen: 1})
+	defer c.Close()
+	ctx := context.Background()
+
+	replies, err := c.Multi(ctx,
+		[]any{"SET", "k", "v"},
+		[]any{"INCR", "k"},
+		[]any{"SET", "k2", "v2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("got %d EXEC replies, want 3: %v", len(replies), replies)
+	}
+	if re, ok := replies[1].(RedisError); !ok || !strings.HasPrefix(string(re), "WRONGTYPE") {
+		t.Errorf("reply 1 = %#v, want a WRONGTYPE error", replies[1])
+	}
+	if toString(replies[2]) != "OK" {
+		t.Errorf("reply 2 = %#v, want OK", replies[2])
+	}
+
+	for _, want := range []string{"one", "two"} {
+		v, err := c.do(ctx, "ECHO", want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if toString(v) != want {
+			t.Fatalf("ECHO %s = %#v: connection out of sync", want, v)
+		}
+	}
+	if n := srv.conns.Load(); n != 1 {
+		t.Errorf("%d connections dialed, want the one reused", n)
+	}
+}
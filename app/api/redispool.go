@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// PoolOptions bounds the connections a RedisClient keeps to the server.
+type PoolOptions struct {
+	MinIdle     int           // connections kept warm by the reaper
+	MaxOpen     int           // hard cap on open connections; callers wait beyond it
+	IdleTimeout time.Duration // idle connections older than this are closed
+	HealthCheck time.Duration // connections idle longer than this are PINGed on checkout
+	DialTimeout time.Duration
+}
+
+func (o PoolOptions) withDefaults() PoolOptions {
+	if o.MaxOpen <= 0 {
+		o.MaxOpen = 16
+	}
+	if o.MinIdle < 0 {
+		o.MinIdle = 0
+	}
+	if o.MinIdle > o.MaxOpen {
+		o.MinIdle = o.MaxOpen
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 5 * time.Minute
+	}
+	if o.HealthCheck <= 0 {
+		o.HealthCheck = 30 * time.Second
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	return o
+}
+
+var errPoolClosed = errors.New("redis: pool closed")
+
+type redisConn struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	lastUsed time.Time
+}
+
+// connPool hands out at most MaxOpen connections; slots is a semaphore
+// holding one token per connection that may still be opened or checked out.
+type connPool struct {
+	addr  string
+	opts  PoolOptions
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*redisConn // LIFO: most recently used at the end
+	closed bool
+	done   chan struct{}
+}
+
+func newConnPool(addr string, opts PoolOptions) *connPool {
+	opts = opts.withDefaults()
+	p := &connPool{
+		addr:  addr,
+		opts:  opts,
+		slots: make(chan struct{}, opts.MaxOpen),
+		done:  make(chan struct{}),
+	}
+	go p.reaper()
+	return p
+}
+
+// get checks out a connection, reusing an idle one when possible. The
+// returned bool reports whether the connection was freshly dialed.
+func (p *connPool) get(ctx context.Context) (*redisConn, bool, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	for {
+		cn, err := p.popIdle()
+		if err != nil {
+			<-p.slots
+			return nil, false, err
+		}
+		if cn == nil {
+			break
+		}
+		if time.Since(cn.lastUsed) < p.opts.HealthCheck || p.ping(ctx, cn) == nil {
+			return cn, false, nil
+		}
+		_ = cn.conn.Close()
+	}
+	cn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, false, err
+	}
+	return cn, true, nil
+}
+
+// dialChecked checks out a freshly dialed connection, skipping idle ones.
+func (p *connPool) dialChecked(ctx context.Context) (*redisConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	cn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put returns cn to the pool, or closes it when broken is set.
+func (p *connPool) put(cn *redisConn, broken bool) {
+	defer func() { <-p.slots }()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if broken || p.closed {
+		_ = cn.conn.Close()
+		return
+	}
+	cn.lastUsed = time.Now()
+	p.idle = append(p.idle, cn)
+}
+
+func (p *connPool) popIdle() (*redisConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errPoolClosed
+	}
+	for len(p.idle) > 0 {
+		cn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(cn.lastUsed) < p.opts.IdleTimeout {
+			return cn, nil
+		}
+		_ = cn.conn.Close()
+	}
+	return nil, nil
+}
+
+func (p *connPool) dial(ctx context.Context) (*redisConn, error) {
+	timeout := p.opts.DialTimeout
+	if dl, ok := ctx.Deadline(); ok {
+		if t := time.Until(dl); t > 0 && t < timeout {
+			timeout = t
+		}
+	}
+	d := &net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{
+		conn:     conn,
+		rw:       bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		lastUsed: time.Now(),
+	}, nil
+}
+
+func (p *connPool) ping(ctx context.Context, cn *redisConn) error {
+	replies, err := cn.roundTrip(ctx, [][]any{{"PING"}})
+	if err != nil {
+		return err
+	}
+	if e, ok := replies[0].(RedisError); ok {
+		return e
+	}
+	return nil
+}
+
+// reaper periodically closes idle connections past IdleTimeout and tops the
+// idle list back up to MinIdle.
+func (p *connPool) reaper() {
+	interval := min(p.opts.IdleTimeout/2, 30*time.Second)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		p.reap()
+		select {
+		case <-t.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *connPool) reap() {
+	p.mu.Lock()
+	kept := p.idle[:0]
+	for _, cn := range p.idle {
+		if time.Since(cn.lastUsed) >= p.opts.IdleTimeout {
+			_ = cn.conn.Close()
+			continue
+		}
+		kept = append(kept, cn)
+	}
+	p.idle = kept
+	missing := p.opts.MinIdle - len(p.idle)
+	p.mu.Unlock()
+
+	for range missing {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.opts.DialTimeout)
+		cn, err := p.dial(ctx)
+		cancel()
+		if err != nil {
+			<-p.slots
+			return
+		}
+		p.put(cn, false)
+	}
+}
+
+func (p *connPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	var firstErr error
+	for _, cn := range p.idle {
+		if err := cn.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.idle = nil
+	return firstErr
+}
+
+// roundTrip writes all cmds in one flush and reads one reply per command.
+// Server error replies are stored as RedisError values in the result slice.
+func (cn *redisConn) roundTrip(ctx context.Context, cmds [][]any) ([]any, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		_ = cn.conn.SetDeadline(dl)
+	} else {
+		_ = cn.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	defer cn.conn.SetDeadline(time.Time{})
+	for _, cmd := range cmds {
+		if err := writeCommand(cn.rw, cmd); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.rw.Flush(); err != nil {
+		return nil, err
+	}
+	out := make([]any, 0, len(cmds))
+	for range cmds {
+		v, err := readResp(cn.rw.Reader)
+		var re RedisError
+		if errors.As(err, &re) {
+			out = append(out, re)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
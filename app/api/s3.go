@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3BlobStore talks to an S3-compatible object store (AWS S3, MinIO, ...)
+// with SigV4-signed requests.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	httpc     *http.Client
+}
+
+func newS3BlobStore(cfg BlobConfig) (*s3BlobStore, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("s3 blob store needs S3_ENDPOINT and S3_BUCKET")
+	}
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, fmt.Errorf("s3 blob store needs S3_ACCESS_KEY and S3_SECRET_KEY")
+	}
+	u, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", cfg.S3Endpoint)
+	}
+	return &s3BlobStore{
+		endpoint:  u,
+		bucket:    cfg.S3Bucket,
+		region:    cfg.S3Region,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		pathStyle: cfg.S3PathStyle,
+		httpc:     &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, data []byte, ctype string) error {
+	return s.PutStream(ctx, key, bytes.NewReader(data), int64(len(data)), sha256Hex(data), ctype)
+}
+
+// PutStream uploads r in a single PUT. The payload hash is signed up front,
+// which is why the caller supplies it.
+func (s *s3BlobStore) PutStream(ctx context.Context, key string, r io.Reader, size int64, sum, ctype string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, r, size, sum, ctype)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", key, resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, emptySHA256, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("get", key, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Delete removes keys one request at a time; S3 answers 204 for missing
+// keys too.
+func (s *s3BlobStore) Delete(ctx context.Context, keys ...string) error {
+	for _, k := range keys {
+		resp, err := s.do(ctx, http.MethodDelete, k, nil, 0, emptySHA256, "")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return s3Error("delete", k, resp)
+		}
+	}
+	return nil
+}
+
+func s3Error(op, key string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %s %s: http %d: %s", op, key, resp.StatusCode, strings.TrimSpace(string(b)))
+}
+
+// emptySHA256 is the payload hash of a request without a body.
+var emptySHA256 = sha256Hex(nil)
+
+// do sends a signed request; sum is the hex SHA-256 of the size bytes of
+// body.
+func (s *s3BlobStore) do(ctx context.Context, method, key string, body io.Reader, size int64, sum, ctype string) (*http.Response, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3Escape(u.Path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	s.sign(req, sum, time.Now().UTC())
+	return s.httpc.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req, whose body hashes to
+// payload. The host and every x-amz-* header are signed.
+func (s *s3BlobStore) sign(req *http.Request, payload string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payload,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, sig))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(msg))
+	return m.Sum(nil)
+}
+
+// s3Escape percent-encodes a path the way SigV4 expects: everything but
+// unreserved characters and '/'.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
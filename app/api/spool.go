@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Uploads are copied to a temporary file as they arrive instead of being
+// read into memory, so the heap cost of an upload no longer grows with its
+// size. The content is hashed and its format sniffed during the copy, and
+// uploadSlots caps how many are handled at once.
+var (
+	// uploadSpoolDir holds spooled uploads (UPLOAD_SPOOL_DIR); empty means
+	// os.TempDir().
+	uploadSpoolDir string
+
+	// uploadSlots has one buffered slot per upload allowed to run at once
+	// (MAX_CONCURRENT_UPLOADS). Nil means no limit.
+	uploadSlots chan struct{}
+
+	errTooLarge    = errors.New("file too large")
+	errUploadsBusy = errors.New("too many concurrent uploads")
+)
+
+func setUploadConcurrency(n int) {
+	if n > 0 {
+		uploadSlots = make(chan struct{}, n)
+	}
+}
+
+// acquireUploadSlot claims an upload slot without waiting. When all are
+// taken it answers 503 and reports false; otherwise the caller must run
+// the returned release func.
+func acquireUploadSlot(w http.ResponseWriter) (func(), bool) {
+	if uploadSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case uploadSlots <- struct{}{}:
+		return func() { <-uploadSlots }, true
+	default:
+		w.Header().Set("Retry-After", "1")
+		httpError(w, http.StatusServiceUnavailable, "too many uploads in progress, retry shortly")
+		return nil, false
+	}
+}
+
+// spooledUpload is an upload held in a temporary file, along with its
+// size, SHA-256 and detected format.
+type spooledUpload struct {
+	f      *os.File
+	size   int64
+	sum    []byte
+	format imageFormat
+}
+
+// spoolUpload copies src to a temporary file. It fails with errTooLarge as
+// soon as more than limit bytes arrive (limit <= 0 means no limit), and
+// with errUnsupportedImage as soon as the leading bytes rule out every
+// allowed format, so a rejected upload is not read to the end.
+func spoolUpload(src io.Reader, limit int64) (*spooledUpload, error) {
+	f, err := os.CreateTemp(uploadSpoolDir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	sp := &spooledUpload{f: f}
+	h := sha256.New()
+	sniff := &sniffWriter{}
+	if limit > 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+	n, err := io.Copy(io.MultiWriter(sniff, h, f), src)
+	if err == nil && !sniff.done {
+		err = sniff.check()
+	}
+	if err == nil && limit > 0 && n > limit {
+		err = errTooLarge
+	}
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	sp.size, sp.sum, sp.format = n, h.Sum(nil), sniff.format
+	return sp, nil
+}
+
+// Reader returns a reader over the whole upload, independent of any other
+// reader returned before.
+func (sp *spooledUpload) Reader() *io.SectionReader {
+	return io.NewSectionReader(sp.f, 0, sp.size)
+}
+
+func (sp *spooledUpload) sha256Hex() string { return hex.EncodeToString(sp.sum) }
+
+// Close removes the temporary file.
+func (sp *spooledUpload) Close() error {
+	sp.f.Close()
+	return os.Remove(sp.f.Name())
+}
+
+// sniffWriter collects the first bytes written through it and checks them
+// against allowedFormats once there are enough to decide.
+type sniffWriter struct {
+	head   []byte
+	done   bool
+	format imageFormat
+}
+
+// sniffLen covers the longest magic number in allowedFormats.
+const sniffLen = 8
+
+func (s *sniffWriter) Write(p []byte) (int, error) {
+	if s.done {
+		return len(p), nil
+	}
+	s.head = append(s.head, p[:min(len(p), sniffLen-len(s.head))]...)
+	if len(s.head) < sniffLen {
+		return len(p), nil
+	}
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *sniffWriter) check() error {
+	s.done = true
+	f, ok := detectFormat(s.head)
+	if !ok {
+		return fmt.Errorf("%w: only JPEG, PNG and GIF are accepted", errUnsupportedImage)
+	}
+	s.format = f
+	return nil
+}
+
+// writeSpoolError answers a failed spoolUpload.
+func writeSpoolError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errTooLarge), errors.As(err, &maxErr):
+		httpError(w, http.StatusRequestEntityTooLarge, "file too large")
+	case errors.Is(err, errUnsupportedImage):
+		httpError(w, http.StatusUnsupportedMediaType, err.Error())
+	default:
+		httpError(w, http.StatusBadRequest, "read failed")
+	}
+}
+
+// putSpooled stores an upload at key. Backends that can take a stream get
+// one; the Redis backend needs the value in one piece anyway, so it is
+// read into memory for the duration of the write.
+func putSpooled(ctx context.Context, key string, sp *spooledUpload, ctype string) error {
+	if s, ok := blobStore.(blobStreamer); ok {
+		return s.PutStream(ctx, key, sp.Reader(), sp.size, sp.sha256Hex(), ctype)
+	}
+	data, err := io.ReadAll(sp.Reader())
+	if err != nil {
+		return err
+	}
+	return blobStore.Put(ctx, key, data, ctype)
+}
+
+// respool writes parts to a new spooled upload, for when the policy
+// rewrites part of an upload.
+func respool(parts ...io.Reader) (*spooledUpload, error) {
+	return spoolUpload(io.MultiReader(parts...), 0)
+}
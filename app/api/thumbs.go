@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+)
+
+// thumbWidths are the widths rendered for every image, set from
+// THUMB_WIDTHS at startup. Only widths narrower than the image are stored.
+var thumbWidths = []int{128, 512, 1024}
+
+const thumbJPEGQuality = 85
+
+// sizesKey holds a hash of width -> height for every stored rendition of a
+// variant, the full-size image included.
+func sizesKey(id, variant string) string {
+	if variant == "" || variant == originalVariant {
+		return "image:sizes:" + id
+	}
+	return "image:sizes:" + id + ":v:" + variant
+}
+
+func thumbKey(id, variant string, width int) string {
+	return variantKey(id, variant) + ":w:" + strconv.Itoa(width)
+}
+
+func thumbCtypeKey(id, variant string, width int) string {
+	return variantCtypeKey(id, variant) + ":w:" + strconv.Itoa(width)
+}
+
+// parseWidths parses a comma-separated list of positive widths.
+func parseWidths(s string) ([]int, error) {
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 || n > maxImageSide {
+			return nil, fmt.Errorf("invalid width %q", f)
+		}
+		out = append(out, n)
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+func formatWidths(ws []int) string {
+	s := make([]string, len(ws))
+	for i, w := range ws {
+		s[i] = strconv.Itoa(w)
+	}
+	return strings.Join(s, ",")
+}
+
+// thumbnail is one downscaled rendition of an upload.
+type thumbnail struct {
+	Width, Height int
+	Data          []byte
+	Ctype         string
+}
+
+// renditions describes an upload and the thumbnails made from it.
+type renditions struct {
+	Width, Height int
+	Thumbs        []thumbnail
+}
+
+// makeThumbnails renders the decoded upload img, of content type ctype, at
+// each of thumbWidths narrower than the image. JPEGs stay JPEG, everything
+// else becomes PNG; animated GIFs get a still of their first frame. The
+// EXIF orientation o is applied since the encoders write no EXIF.
+func makeThumbnails(img image.Image, ctype string, o int) (*renditions, error) {
+	var src *image.NRGBA
+	if o > 1 {
+		src = orientImage(img, o)
+	} else {
+		src = toNRGBA(img)
+	}
+	r := &renditions{Width: src.Rect.Dx(), Height: src.Rect.Dy()}
+	for _, w := range thumbWidths {
+		if w >= r.Width {
+			break
+		}
+		h := max(1, (r.Height*w+r.Width/2)/r.Width)
+		t := thumbnail{Width: w, Height: h}
+		var buf bytes.Buffer
+		small := downscale(src, w, h)
+		var err error
+		if ctype == "image/jpeg" {
+			err = jpeg.Encode(&buf, small, &jpeg.Options{Quality: thumbJPEGQuality})
+			t.Ctype = "image/jpeg"
+		} else {
+			err = png.Encode(&buf, small)
+			t.Ctype = "image/png"
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encode %dpx thumbnail: %w", w, err)
+		}
+		t.Data = buf.Bytes()
+		r.Thumbs = append(r.Thumbs, t)
+	}
+	return r, nil
+}
+
+// toNRGBA returns img as an NRGBA image with its origin at zero, copying
+// only when it is not one already.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+		return n
+	}
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// downscale shrinks src to w x h by averaging the source pixels each
+// destination pixel covers. Colour is weighted by alpha so transparent
+// pixels do not darken edges.
+func downscale(src *image.NRGBA, w, h int) *image.NRGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := sy*src.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					pa := uint64(src.Pix[i+3])
+					r += uint64(src.Pix[i]) * pa
+					g += uint64(src.Pix[i+1]) * pa
+					bl += uint64(src.Pix[i+2]) * pa
+					a += pa
+					n++
+					i += 4
+				}
+			}
+			d := dst.PixOffset(x, y)
+			if a > 0 {
+				dst.Pix[d] = uint8(r / a)
+				dst.Pix[d+1] = uint8(g / a)
+				dst.Pix[d+2] = uint8(bl / a)
+				dst.Pix[d+3] = uint8(a / n)
+			}
+		}
+	}
+	return dst
+}
+
+// imageSize is one entry of a post's srcset listing.
+type imageSize struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// postImage describes one image of a post, in its active variant, and its
+// available sizes, narrowest first, ready to be turned into an <img srcset>.
+type postImage struct {
+	ID      string      `json:"id"`
+	URL     string      `json:"url"`
+	Variant string      `json:"variant"`
+	Sizes   []imageSize `json:"sizes"`
+}
+
+// imageInfos looks up the active variant and sizes of each image. Images
+// that predate size tracking are listed without sizes.
+func imageInfos(ctx context.Context, ids []string) (map[string]*postImage, error) {
+	out := make(map[string]*postImage, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	pipe := rdb.Pipeline()
+	for _, id := range ids {
+		pipe.Do("GET", activeFxKey(id))
+	}
+	actives, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	variants := make([]string, len(ids))
+	pipe = rdb.Pipeline()
+	for i, id := range ids {
+		variants[i] = originalVariant
+		if b, ok := actives[i].([]byte); ok && len(b) > 0 {
+			variants[i] = string(b)
+		}
+		pipe.Do("HGETALL", sizesKey(id, variants[i]))
+	}
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		base := imageURL(id)
+		pi := &postImage{ID: id, URL: base, Variant: variants[i], Sizes: []imageSize{}}
+		sizes, _ := parseHash(replies[i])
+		for w, h := range sizes {
+			wi, err1 := strconv.Atoi(w)
+			hi, err2 := strconv.Atoi(h)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			pi.Sizes = append(pi.Sizes, imageSize{Width: wi, Height: hi, URL: base + "?w=" + w})
+		}
+		sort.Slice(pi.Sizes, func(a, b int) bool { return pi.Sizes[a].Width < pi.Sizes[b].Width })
+		out[id] = pi
+	}
+	return out, nil
+}
+
+// pickWidth chooses the narrowest stored thumbnail at least want pixels
+// wide. It returns 0 when only the full-size image (the widest entry in
+// sizes) is wide enough.
+func pickWidth(sizes map[string]string, want int) int {
+	full, best := 0, 0
+	for k := range sizes {
+		w, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		full = max(full, w)
+	}
+	for k := range sizes {
+		w, _ := strconv.Atoi(k)
+		if w >= want && w < full && (best == 0 || w < best) {
+			best = w
+		}
+	}
+	return best
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads follow the tus 1.0 core protocol with the creation,
+// expiration and termination extensions: POST /uploads opens a session for
+// a post, PATCH /uploads/{uid} appends a chunk at Upload-Offset, HEAD
+// reports how far the server got, and DELETE abandons the session. Once the
+// last byte arrives the image goes through the same policy as a direct
+// upload and is added to the post's gallery. Session state lives in Redis
+// under keys that expire after uploadSessionTTL without activity, so
+// abandoned uploads clean themselves up.
+const tusVersion = "1.0.0"
+
+// uploadSessionTTL is how long an idle session is kept (UPLOAD_SESSION_TTL).
+var uploadSessionTTL = 24 * time.Hour
+
+// uploadPieceSize is how much of a chunk is read before it is appended
+// in Redis.
+const uploadPieceSize = 1 << 20
+
+// uploadLockTTL bounds how long a crashed PATCH can keep a session locked.
+const uploadLockTTL = 5 * time.Minute
+
+var errUploadGone = errors.New("upload not found")
+
+// errUploadMoved means the data of a session changed under a PATCH, which
+// only happens when the lock expired and another request took over.
+var errUploadMoved = errors.New("upload offset moved")
+
+func uploadKey(uid string) string     { return "upload:" + uid }
+func uploadDataKey(uid string) string { return "upload:data:" + uid }
+func uploadLockKey(uid string) string { return "upload:lock:" + uid }
+
+// uploadSession is the state kept in the upload:<uid> hash plus the length
+// of the data received so far.
+type uploadSession struct {
+	PostID   string
+	Filename string
+	Length   int64
+	Offset   int64
+}
+
+// withTus adds the tus discovery headers to every response and refuses
+// requests speaking another protocol version.
+func withTus(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Tus-Resumable", tusVersion)
+		h.Set("Tus-Version", tusVersion)
+		h.Set("Tus-Extension", "creation,expiration,termination")
+		h.Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			httpError(w, http.StatusPreconditionFailed, "unsupported Tus-Resumable version")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	uid := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if uid == "" {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleCreateUpload(w, r)
+		return
+	}
+	if !idRe.MatchString(uid) {
+		httpError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		handleUploadOffset(w, r, uid)
+	case http.MethodPatch:
+		if err := handleUploadChunk(w, r, uid); err != nil {
+			log.Printf("[upload] patch uid=%s: %v", uid, err)
+		}
+	case http.MethodDelete:
+		handleTerminateUpload(w, r, uid)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		httpError(w, http.StatusBadRequest, "Upload-Length must be a positive integer")
+		return
+	}
+	if length > maxUploadSize {
+		httpError(w, http.StatusRequestEntityTooLarge, "file too large")
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	postID := meta["post_id"]
+	if !idRe.MatchString(postID) {
+		httpError(w, http.StatusBadRequest, "Upload-Metadata needs a valid post_id")
+		return
+	}
+	if n, err := rdb.Exists(ctx, "post:"+postID); err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return
+	} else if n == 0 {
+		httpError(w, http.StatusNotFound, "post not found")
+		return
+	}
+
+	uid, err := randomID(12)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "id generation failed")
+		return
+	}
+	ttl := strconv.Itoa(int(uploadSessionTTL.Seconds()))
+	_, err = rdb.Multi(ctx,
+		[]any{"HSET", uploadKey(uid), "post_id", postID, "length", strconv.FormatInt(length, 10), "filename", meta["filename"]},
+		[]any{"SET", uploadDataKey(uid), ""},
+		[]any{"EXPIRE", uploadKey(uid), ttl},
+		[]any{"EXPIRE", uploadDataKey(uid), ttl},
+	)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return
+	}
+	log.Printf("[upload] created uid=%s post=%s length=%d name=%q", uid, postID, length, meta["filename"])
+	// Relative to the request URL, so it stays correct behind the frontend
+	// proxy, which serves the API under a path prefix.
+	w.Header().Set("Location", "uploads/"+uid)
+	w.Header().Set("Upload-Expires", uploadExpires())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleUploadOffset(w http.ResponseWriter, r *http.Request, uid string) {
+	s, err := loadUploadSession(r.Context(), uid)
+	if errors.Is(err, errUploadGone) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[upload] head uid=%s: %v", uid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUploadChunk appends one chunk. Whatever part of the body arrived
+// before a dropped connection is kept, so the client can resume from the
+// offset HEAD reports rather than resending the whole chunk.
+func handleUploadChunk(w http.ResponseWriter, r *http.Request, uid string) error {
+	release, ok := acquireUploadSlot(w)
+	if !ok {
+		return errUploadsBusy
+	}
+	defer release()
+	ctx := r.Context()
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		httpError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return nil
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		httpError(w, http.StatusBadRequest, "Upload-Offset must be a non-negative integer")
+		return nil
+	}
+
+	unlock, err := lockUpload(ctx, uid)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return err
+	}
+	if unlock == nil {
+		httpError(w, http.StatusLocked, "another request is writing to this upload")
+		return nil
+	}
+	defer unlock()
+
+	s, err := loadUploadSession(ctx, uid)
+	if errors.Is(err, errUploadGone) {
+		httpError(w, http.StatusNotFound, "upload not found")
+		return nil
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return err
+	}
+	if offset != s.Offset {
+		httpError(w, http.StatusConflict, fmt.Sprintf("Upload-Offset is %d, expected %d", offset, s.Offset))
+		return nil
+	}
+
+	if r.ContentLength > s.Length-s.Offset {
+		httpError(w, http.StatusRequestEntityTooLarge, "chunk exceeds Upload-Length")
+		return nil
+	}
+	// Append in pieces as the body arrives rather than buffering it.
+	buf := make([]byte, max(1, min(uploadPieceSize, s.Length-s.Offset)))
+	for {
+		n, err := io.ReadFull(r.Body, buf[:min(int64(len(buf)), s.Length-s.Offset)])
+		if n > 0 {
+			off, aerr := appendUpload(ctx, uid, s.Offset, buf[:n])
+			switch {
+			case errors.Is(aerr, errUploadGone):
+				httpError(w, http.StatusNotFound, "upload not found")
+				return nil
+			case errors.Is(aerr, errUploadMoved):
+				httpError(w, http.StatusConflict, "upload was written to by another request")
+				return aerr
+			case aerr != nil:
+				httpError(w, http.StatusInternalServerError, "redis error")
+				return aerr
+			}
+			s.Offset = off
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			// The client is most likely gone; nobody reads this response.
+			httpError(w, http.StatusBadRequest, "read failed")
+			return fmt.Errorf("read chunk at %d: %w (kept %d bytes)", offset, err, s.Offset-offset)
+		}
+		if s.Offset == s.Length {
+			if extra, _ := r.Body.Read(buf[:1]); extra > 0 {
+				httpError(w, http.StatusRequestEntityTooLarge, "chunk exceeds Upload-Length")
+				return nil
+			}
+			break
+		}
+	}
+
+	if s.Offset == s.Length {
+		if err := finishUpload(ctx, w, uid, s); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Expires", uploadExpires())
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// finishUpload adds a completed upload to the post's gallery and drops the
+// session. A save failure keeps the session, so an empty PATCH at the final
+// offset retries it; rejected images, and uploads to a post deleted in the
+// meantime, are dropped along with it.
+func finishUpload(ctx context.Context, w http.ResponseWriter, uid string, s uploadSession) error {
+	imageID, n, ctype, err := ingestUpload(ctx, w, uid, s)
+	if err != nil && !errors.Is(err, errUnsupportedImage) && !errors.Is(err, errPostNotFound) {
+		return err
+	}
+	if _, derr := rdb.Del(ctx, uploadKey(uid), uploadDataKey(uid)); derr != nil {
+		log.Printf("[upload] cleanup uid=%s: %v", uid, derr)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[gallery] added post=%s image=%s uid=%s name=%q bytes=%d ctype=%s", s.PostID, imageID, uid, s.Filename, n, ctype)
+	return nil
+}
+
+// ingestUpload spools the data of upload uid out of Redis and stores it as
+// a new image of the post. On failure the error response has already been
+// written.
+func ingestUpload(ctx context.Context, w http.ResponseWriter, uid string, s uploadSession) (string, int64, string, error) {
+	// A session can stay open for hours; skip the work if the post went
+	// away. addGalleryImage checks again, atomically, at the end.
+	if n, err := rdb.Exists(ctx, "post:"+s.PostID); err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return "", 0, "", err
+	} else if n == 0 {
+		httpError(w, http.StatusNotFound, "post not found")
+		return "", 0, "", errPostNotFound
+	}
+	sp, err := spoolUpload(&redisRangeReader{ctx: ctx, key: uploadDataKey(uid), size: s.Length}, 0)
+	if errors.Is(err, errUnsupportedImage) {
+		writeSpoolError(w, err)
+		return "", 0, "", err
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return "", 0, "", err
+	}
+	defer sp.Close()
+	imageID, err := newImageID(ctx)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "id generation failed")
+		return "", 0, "", err
+	}
+	n, ctype, err := ingestImage(ctx, w, imageID, sp)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if err := addGalleryImage(ctx, s.PostID, imageID); err != nil {
+		writeAddImageError(ctx, w, imageID, err)
+		return "", 0, "", err
+	}
+	return imageID, n, ctype, nil
+}
+
+// appendUpload adds p to the data of upload uid at offset, refreshing the
+// expiry of the session, and returns the new offset. The data is watched
+// so the append only goes through if nothing else wrote to it since its
+// length was checked; otherwise errUploadMoved is returned.
+func appendUpload(ctx context.Context, uid string, offset int64, p []byte) (int64, error) {
+	ttl := strconv.Itoa(int(uploadSessionTTL.Seconds()))
+	key, dataKey := uploadKey(uid), uploadDataKey(uid)
+	replies, err := rdb.Watch(ctx, []string{key, dataKey}, func(tx *Tx) ([][]any, error) {
+		if v, err := tx.Do("EXISTS", key); err != nil {
+			return nil, err
+		} else if v != int64(1) {
+			return nil, errUploadGone
+		}
+		v, err := tx.Do("STRLEN", dataKey)
+		if err != nil {
+			return nil, err
+		}
+		if v != offset {
+			return nil, errUploadMoved
+		}
+		return [][]any{
+			{"APPEND", dataKey, p},
+			{"EXPIRE", key, ttl},
+			{"EXPIRE", dataKey, ttl},
+		}, nil
+	})
+	if errors.Is(err, ErrTxAborted) {
+		return 0, errUploadMoved
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("APPEND: unexpected reply %v", replies[0])
+	}
+	return n, nil
+}
+
+// redisRangeReader reads a Redis string of known size in pieces, so a
+// finished upload can be spooled without holding it all in memory.
+type redisRangeReader struct {
+	ctx       context.Context
+	key       string
+	off, size int64
+}
+
+func (rr *redisRangeReader) Read(p []byte) (int, error) {
+	if rr.off >= rr.size {
+		return 0, io.EOF
+	}
+	b, err := rdb.GetRange(rr.ctx, rr.key, rr.off, rr.off+min(int64(len(p)), rr.size-rr.off)-1)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	rr.off += int64(copy(p, b))
+	return len(b), nil
+}
+
+// WriteTo lets io.Copy fetch uploadPieceSize at a time instead of its
+// default 32 KiB.
+func (rr *redisRangeReader) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, uploadPieceSize)
+	var total int64
+	for {
+		n, err := rr.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			total += int64(m)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func handleTerminateUpload(w http.ResponseWriter, r *http.Request, uid string) {
+	n, err := rdb.Del(r.Context(), uploadKey(uid), uploadDataKey(uid))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "redis error")
+		return
+	}
+	if n == 0 {
+		httpError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	log.Printf("[upload] terminated uid=%s", uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func loadUploadSession(ctx context.Context, uid string) (uploadSession, error) {
+	pipe := rdb.Pipeline()
+	hi := pipe.Do("HGETALL", uploadKey(uid))
+	li := pipe.Do("STRLEN", uploadDataKey(uid))
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	m, err := parseHash(replies[hi])
+	if err != nil {
+		return uploadSession{}, err
+	}
+	if len(m) == 0 {
+		return uploadSession{}, errUploadGone
+	}
+	length, err := strconv.ParseInt(m["length"], 10, 64)
+	if err != nil {
+		return uploadSession{}, fmt.Errorf("upload %s: bad length %q", uid, m["length"])
+	}
+	offset, ok := replies[li].(int64)
+	if !ok {
+		return uploadSession{}, fmt.Errorf("STRLEN: unexpected reply %v", replies[li])
+	}
+	return uploadSession{PostID: m["post_id"], Filename: m["filename"], Length: length, Offset: offset}, nil
+}
+
+// lockUpload takes the per-session write lock. It returns a nil release
+// func if another request holds it. The lock holds a random token and is
+// only released while it still holds that token, so a request that
+// outlived uploadLockTTL cannot drop a lock since taken by another.
+func lockUpload(ctx context.Context, uid string) (func(), error) {
+	token, err := randomID(16)
+	if err != nil {
+		return nil, err
+	}
+	key := uploadLockKey(uid)
+	pipe := rdb.Pipeline()
+	pipe.Do("SET", key, token, "NX", "PX", strconv.FormatInt(uploadLockTTL.Milliseconds(), 10))
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(RedisError); ok {
+		return nil, e
+	}
+	if replies[0] == nil {
+		return nil, nil
+	}
+	return func() {
+		// The request context may already be cancelled by a dropped client.
+		_, err := rdb.Watch(context.Background(), []string{key}, func(tx *Tx) ([][]any, error) {
+			v, err := tx.Do("GET", key)
+			if err != nil || toString(v) != token {
+				return nil, err
+			}
+			return [][]any{{"DEL", key}}, nil
+		})
+		if err != nil {
+			log.Printf("[upload] unlock uid=%s: %v", uid, err)
+		}
+	}, nil
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma-separated
+// pairs of a key and an optional base64 value.
+func parseUploadMetadata(h string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, pair := range strings.Split(h, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, " ")
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata: %s is not base64", k)
+		}
+		out[k] = string(b)
+	}
+	return out, nil
+}
+
+func uploadExpires() string {
+	return time.Now().Add(uploadSessionTTL).UTC().Format(http.TimeFormat)
+}
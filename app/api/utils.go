@@ -6,8 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path"
-	"strings"
+	"strconv"
 	"time"
 )
 
@@ -21,12 +20,43 @@ func getenv(k, def string) string {
 	return def
 }
 
+// getenvInt parses env var k as an int, falling back to def if unset or invalid.
+func getenvInt(k string, def int) int {
+	n, err := strconv.Atoi(getenv(k, strconv.Itoa(def)))
+	if err != nil {
+		log.Printf("[env] %s invalid, using default=%d", k, def)
+		return def
+	}
+	return n
+}
+
+// getenvDuration parses env var k as a time.Duration, falling back to def.
+func getenvDuration(k string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(getenv(k, def.String()))
+	if err != nil {
+		log.Printf("[env] %s invalid, using default=%s", k, def)
+		return def
+	}
+	return d
+}
+
+// getenvBool parses env var k with strconv.ParseBool, falling back to def.
+func getenvBool(k string, def bool) bool {
+	b, err := strconv.ParseBool(getenv(k, strconv.FormatBool(def)))
+	if err != nil {
+		log.Printf("[env] %s invalid, using default=%t", k, def)
+		return def
+	}
+	return b
+}
+
 // withCORS adds permissive CORS headers for simple APIs.
 func withCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Expose-Headers", "Link, ETag, Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -46,6 +76,10 @@ func (sr *statusRecorder) WriteHeader(code int) {
 	sr.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush a streamed response.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter { return sr.ResponseWriter }
+
 // logRequests wraps handlers to log method, path, status, and duration.
 func logRequests(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -68,25 +102,6 @@ func writeJSON(w http.ResponseWriter, code int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-// sniffContentType infers a reasonable content-type from filename or bytes.
-func sniffContentType(filename string, data []byte) string {
-	ext := strings.ToLower(path.Ext(filename))
-	switch ext {
-	case ".png":
-		return "image/png"
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".gif":
-		return "image/gif"
-	case ".webp":
-		return "image/webp"
-	case ".svg":
-		return "image/svg+xml"
-	default:
-		return http.DetectContentType(data)
-	}
-}
-
 // base62 alphabet for randomID.
 const base62 = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+)
+
+// maxImagePixels bounds width*height of an upload (MAX_IMAGE_PIXELS), so a
+// small compressed file cannot expand into gigabytes once decoded.
+var maxImagePixels = 40_000_000
+
+// maxAnimationPixels bounds the summed area of all frames of a GIF, which
+// image-job holds in memory at once.
+const maxAnimationPixels = 100_000_000
+
+// errUnsupportedImage marks uploads rejected by validateImage; they are
+// answered with 415.
+var errUnsupportedImage = errors.New("unsupported image")
+
+// imageFormat is an accepted upload format, recognised by its leading bytes.
+type imageFormat struct {
+	name  string // as reported by image.DecodeConfig
+	ctype string
+	magic [][]byte
+}
+
+var allowedFormats = []imageFormat{
+	{"jpeg", "image/jpeg", [][]byte{{0xFF, 0xD8, 0xFF}}},
+	{"png", "image/png", [][]byte{[]byte("\x89PNG\r\n\x1a\n")}},
+	{"gif", "image/gif", [][]byte{[]byte("GIF87a"), []byte("GIF89a")}},
+}
+
+func detectFormat(data []byte) (imageFormat, bool) {
+	for _, f := range allowedFormats {
+		for _, m := range f.magic {
+			if bytes.HasPrefix(data, m) {
+				return f, true
+			}
+		}
+	}
+	return imageFormat{}, false
+}
+
+// validateImage checks that the upload is one of allowedFormats by its
+// magic bytes, that its header declares bounded dimensions, and that it
+// then decodes cleanly. It returns the content type to store, derived from
+// the data rather than anything the client sent, and the decoded image (the
+// first frame of a GIF) so it need not be decoded again.
+func validateImage(r io.ReadSeeker) (string, image.Image, error) {
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(r, head)
+	f, ok := detectFormat(head[:n])
+	if !ok {
+		return "", nil, fmt.Errorf("%w: only JPEG, PNG and GIF are accepted", errUnsupportedImage)
+	}
+	// DecodeConfig reads only the header, so oversized images are refused
+	// before any pixel buffer is allocated.
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	cfg, name, err := image.DecodeConfig(bufio.NewReader(r))
+	if err != nil || name != f.name {
+		return "", nil, fmt.Errorf("%w: corrupt %s header", errUnsupportedImage, f.name)
+	}
+	if err := checkDimensions(cfg.Width, cfg.Height); err != nil {
+		return "", nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	if f.name == "gif" {
+		frames, err := gifFrameCount(r)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: corrupt gif: %v", errUnsupportedImage, err)
+		}
+		if int64(frames)*int64(cfg.Width)*int64(cfg.Height) > maxAnimationPixels {
+			return "", nil, fmt.Errorf("%w: animation of %d frames at %dx%d is too large", errUnsupportedImage, frames, cfg.Width, cfg.Height)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return "", nil, err
+		}
+		g, err := gif.DecodeAll(bufio.NewReader(r))
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: corrupt gif: %v", errUnsupportedImage, err)
+		}
+		return f.ctype, g.Image[0], nil
+	}
+	img, _, err := image.Decode(bufio.NewReader(r))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: corrupt %s: %v", errUnsupportedImage, f.name, err)
+	}
+	return f.ctype, img, nil
+}
+
+func checkDimensions(w, h int) error {
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("%w: empty image", errUnsupportedImage)
+	}
+	if w > maxImageSide || h > maxImageSide || int64(w)*int64(h) > int64(maxImagePixels) {
+		return fmt.Errorf("%w: %dx%d exceeds the limit of %d px per side and %d px total",
+			errUnsupportedImage, w, h, maxImageSide, maxImagePixels)
+	}
+	return nil
+}
+
+// gifFrameCount walks the GIF block structure without decompressing any
+// image data and returns the number of frames.
+func gifFrameCount(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var hdr [13]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return 0, errors.New("short header")
+	}
+	if hdr[10]&0x80 != 0 { // global colour table
+		if _, err := br.Discard(3 << (hdr[10]&7 + 1)); err != nil {
+			return 0, errors.New("truncated colour table")
+		}
+	}
+	frames := 0
+	for {
+		block, err := br.ReadByte()
+		if err == io.EOF {
+			// Go's decoder tolerates a missing trailer, so do the same.
+			return frames, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch block {
+		case 0x3B: // trailer
+			return frames, nil
+		case 0x21: // extension: label, then sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return 0, errors.New("truncated extension")
+			}
+		case 0x2C: // image descriptor, optional local colour table, LZW min code size
+			var desc [9]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return 0, errors.New("truncated image descriptor")
+			}
+			if flags := desc[8]; flags&0x80 != 0 {
+				if _, err := br.Discard(3 << (flags&7 + 1)); err != nil {
+					return 0, errors.New("truncated colour table")
+				}
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return 0, errors.New("truncated image descriptor")
+			}
+			frames++
+		default:
+			return 0, fmt.Errorf("unknown block 0x%02x", block)
+		}
+		// Skip data sub-blocks up to the zero-length terminator.
+		for {
+			n, err := br.ReadByte()
+			if err != nil {
+				return 0, errors.New("truncated block")
+			}
+			if n == 0 {
+				break
+			}
+			if _, err := br.Discard(int(n)); err != nil {
+				return 0, errors.New("truncated block")
+			}
+		}
+	}
+}
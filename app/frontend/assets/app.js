@@ -47,6 +47,14 @@ function errorDetailsHTML(err) {
     return escapeHTML(JSON.stringify(err));
 }
 
+// srcset/sizes attributes from the size listing in the post JSON, so the
+// browser fetches a thumbnail instead of the full image where it can.
+function imageSrcset(image) {
+    if (!image || !image.sizes || image.sizes.length < 2) return "";
+    const set = image.sizes.map((s) => `${API}${s.url} ${s.width}w`).join(", ");
+    return `srcset="${escapeHTML(set)}" sizes="(max-width: 1024px) 100vw, 1024px"`;
+}
+
 class BlogApp extends HTMLElement {
     constructor() {
         super();
@@ -76,8 +84,9 @@ class BlogApp extends HTMLElement {
     async renderList() {
         this.view.innerHTML = `<div class="loading blink">Loading posts…</div>`;
         try {
-            const posts = await httpJSON(`${API}/posts`);
-            if (!Array.isArray(posts) || posts.length === 0) {
+            const page = await httpJSON(`${API}/posts`);
+            const posts = page && Array.isArray(page.posts) ? page.posts : [];
+            if (posts.length === 0) {
                 this.view.innerHTML = `
           <h2 class="rainbow-text big">Latest Posts</h2>
           <p>No posts yet… <a class="loud-link" href="#/new">click here to create one</a>.</p>
@@ -88,15 +97,29 @@ class BlogApp extends HTMLElement {
         <h2 class="rainbow-text big">Latest Posts</h2>
         <table class="table-90s">
           <thead><tr><th>Title</th><th>Published</th></tr></thead>
-          <tbody>
-            ${posts.map(p => `
+          <tbody></tbody>
+        </table>
+        <p><button id="olderBtn" class="btn-3d btn-yellow" style="display:none">Older posts</button></p>
+      `;
+            const tbody = this.view.querySelector("tbody");
+            const older = this.view.querySelector("#olderBtn");
+            const appendPage = (pg) => {
+                tbody.insertAdjacentHTML("beforeend", (pg.posts || []).map(p => `
               <tr>
                 <td><a class="loud-link" href="#/post/${encodeURIComponent(p.id)}">${escapeHTML(p.title)}</a></td>
                 <td>${new Date(p.created_at * 1000).toLocaleString()}</td>
-              </tr>`).join("")}
-          </tbody>
-        </table>
-      `;
+              </tr>`).join(""));
+                older.dataset.cursor = pg.next_cursor || "";
+                older.style.display = pg.next_cursor ? "inline-block" : "none";
+            };
+            appendPage(page);
+            older.addEventListener("click", async () => {
+                try {
+                    appendPage(await httpJSON(`${API}/posts?cursor=${encodeURIComponent(older.dataset.cursor)}`));
+                } catch (err) {
+                    older.insertAdjacentHTML("afterend", `<div class="error">${errorDetailsHTML(err)}</div>`);
+                }
+            });
         } catch (err) {
             this.view.innerHTML = renderErrorCard("Latest Posts", errorDetailsHTML(err));
         }
@@ -106,16 +129,19 @@ class BlogApp extends HTMLElement {
         this.view.innerHTML = `<div class="loading blink">Loading post…</div>`;
         try {
             const p = await httpJSON(`${API}/posts/${encodeURIComponent(id)}`);
+            const images = p.images || (p.image ? [p.image] : []);
             this.view.innerHTML = `
         <div class="post-window bevel">
           <div class="titlebar">
             <span>📝 ${escapeHTML(p.title)}</span>
           </div>
           <div class="post-body">
+            ${images.map((img, i) => `
             <img class="post-image funky-border"
-                 src="${API}/images/${encodeURIComponent(p.id)}"
-                 alt="${escapeHTML(p.title)} image"
-                 onerror="this.remove()"/>
+                 src="${API}${img.url}"
+                 ${imageSrcset(img)}
+                 alt="${escapeHTML(p.title)} image ${i + 1}"
+                 onerror="this.remove()"/>`).join("")}
             <pre class="body mono">${escapeHTML(p.body)}</pre>
           </div>
           <p><a class="loud-link" href="#/">← Back</a></p>
@@ -132,7 +158,7 @@ class BlogApp extends HTMLElement {
         <h2 class="rainbow-text">Create New Post</h2>
         <label>Title <input name="title" required /></label>
         <label>Body <textarea name="body" rows="8" required></textarea></label>
-        <label>Image <input type="file" name="image" accept="image/*" /></label>
+        <label>Images <input type="file" name="image" accept="image/*" multiple /></label>
         <div id="effectsSection" style="display:none; margin-top:8px;">
           <strong>Effects</strong>
           <div>
@@ -140,7 +166,7 @@ class BlogApp extends HTMLElement {
             <label><input type="radio" name="effect" value="grayscale" /> Grayscale</label>
             <label><input type="radio" name="effect" value="invert" /> Invert</label>
           </div>
-          <p class="hint">Effect runs as a Kubernetes Job after upload.</p>
+          <p class="hint">Effect runs on the first image as a Kubernetes Job after upload.</p>
         </div>
         <button type="submit" class="btn-3d btn-yellow">Create</button>
       </form>
@@ -168,7 +194,7 @@ class BlogApp extends HTMLElement {
             const fd = new FormData(form);
             const title = fd.get("title");
             const body = fd.get("body");
-            const image = fileInput.files && fileInput.files[0] ? fileInput.files[0] : null;
+            const images = fileInput.files ? Array.from(fileInput.files) : [];
             const effect = (fd.get("effect") || "none").toString();
 
             let post;
@@ -183,21 +209,19 @@ class BlogApp extends HTMLElement {
                 return;
             }
 
-            if (image) {
-                try {
-                    const imgFd = new FormData();
-                    imgFd.set("file", image);
-                    const upRes = await fetch(`${API}/images/${post.id}`, { method: "POST", body: imgFd });
-                    if (!upRes.ok) {
-                        const t = await upRes.text().catch(() => "");
-                        statusEl.innerHTML = `<div class="error">Image upload failed: HTTP ${upRes.status} ${escapeHTML(upRes.statusText)} ${escapeHTML(snippet(t))}</div>`;
+            if (images.length > 0) {
+                const uploaded = [];
+                for (const image of images) {
+                    statusEl.innerHTML = `<div class="blink">⏫ Uploading ${escapeHTML(image.name)}…</div>`;
+                    try {
+                        const imgFd = new FormData();
+                        imgFd.set("file", image);
+                        uploaded.push(await httpJSON(`${API}/posts/${encodeURIComponent(post.id)}/images`, { method: "POST", body: imgFd }));
+                    } catch (err) {
+                        statusEl.innerHTML = `<div class="error">Upload of ${escapeHTML(image.name)} failed: ${errorDetailsHTML(err)}</div>`;
                         location.hash = `#/post/${encodeURIComponent(post.id)}`;
                         return;
                     }
-                } catch (err) {
-                    statusEl.innerHTML = `<div class="error">Image upload failed: ${errorDetailsHTML(err)}</div>`;
-                    location.hash = `#/post/${encodeURIComponent(post.id)}`;
-                    return;
                 }
 
                 if (effect !== "none") {
@@ -207,7 +231,7 @@ class BlogApp extends HTMLElement {
                         const job = await httpJSON(`${API}/jobs/effect`, {
                             method: "POST",
                             headers: { "Content-Type": "application/json" },
-                            body: JSON.stringify({ post_id: post.id, effect })
+                            body: JSON.stringify({ post_id: post.id, image_id: uploaded[0].id, effect })
                         });
                         jobName = job.job_name;
                     } catch (err) {
@@ -238,7 +262,12 @@ class BlogApp extends HTMLElement {
                     onSuccess();
                     break;
                 } else if (st.status === "failed") {
-                    statusEl.innerHTML = `<div class="error">❌ Job failed: ${escapeHTML(st.reason || "unknown error")}</div>`;
+                    const logsURL = `${API}/jobs/${encodeURIComponent(jobName)}/logs`;
+                    statusEl.innerHTML = `<div class="error">❌ Job failed: ${escapeHTML(st.reason || "unknown error")} (<a href="${logsURL}" target="_blank" rel="noopener">logs</a>)</div>`;
+                    done = true;
+                    break;
+                } else if (st.status === "cancelled") {
+                    statusEl.innerHTML = `<div class="error">Job <b>${escapeHTML(jobName)}</b> was cancelled.</div>`;
                     done = true;
                     break;
                 } else {
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for keys that hold nothing.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore holds image bytes under the same keys the API uses; content
+// types, sizes and the variant set stay in Redis whatever the backend.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, ctype string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// BlobConfig selects and configures a BlobStore. The API passes its own
+// settings to the job, so both read and write the same place.
+type BlobConfig struct {
+	Backend     string // redis | fs | s3
+	Dir         string // fs: directory, typically a PVC mount
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool // bucket in the path rather than the host name, as MinIO expects
+}
+
+func blobConfigFromEnv() BlobConfig {
+	return BlobConfig{
+		Backend:     strings.ToLower(getenv("BLOB_STORE", "redis")),
+		Dir:         getenv("BLOB_DIR", "/data/images"),
+		S3Endpoint:  getenv("S3_ENDPOINT", ""),
+		S3Bucket:    getenv("S3_BUCKET", ""),
+		S3Region:    getenv("S3_REGION", "us-east-1"),
+		S3AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey: os.Getenv("S3_SECRET_KEY"),
+		S3PathStyle: getenv("S3_PATH_STYLE", "true") != "false",
+	}
+}
+
+// NewBlobStore builds the backend named by cfg.Backend.
+func NewBlobStore(cfg BlobConfig, rdb *RedisClient) (BlobStore, error) {
+	switch cfg.Backend {
+	case "", "redis":
+		return redisBlobStore{rdb}, nil
+	case "fs":
+		return newFSBlobStore(cfg.Dir)
+	case "s3":
+		return newS3BlobStore(cfg)
+	}
+	return nil, fmt.Errorf("unknown BLOB_STORE %q (want redis, fs or s3)", cfg.Backend)
+}
+
+// blobInfoKey holds the ETag and modification time the API serves with the
+// blob at key.
+func blobInfoKey(key string) string {
+	return "image:info:" + strings.TrimPrefix(key, "image:")
+}
+
+// blobInfo returns the fields stored under blobInfoKey for data, matching
+// what the API writes for uploads.
+func blobInfo(data []byte) map[string]any {
+	h := sha256.Sum256(data)
+	return map[string]any{
+		"etag":     `"` + hex.EncodeToString(h[:16]) + `"`,
+		"modified": strconv.FormatInt(time.Now().Unix(), 10),
+	}
+}
+
+// redisBlobStore keeps bytes in Redis string values.
+type redisBlobStore struct{ rdb *RedisClient }
+
+func (s redisBlobStore) Put(ctx context.Context, key string, data []byte, _ string) error {
+	return s.rdb.Set(ctx, key, data, 0)
+}
+
+func (s redisBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := s.rdb.GetBytes(ctx, key)
+	if errors.Is(err, ErrNil) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s redisBlobStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.rdb.Del(ctx, keys...)
+}
+
+// fsBlobStore keeps one file per key in a flat directory.
+type fsBlobStore struct{ dir string }
+
+func newFSBlobStore(dir string) (*fsBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("blob dir: %w", err)
+	}
+	return &fsBlobStore{dir: dir}, nil
+}
+
+func (s *fsBlobStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Put writes to a temporary file and renames it over the target, so
+// readers never see a partial image.
+func (s *fsBlobStore) Put(_ context.Context, key string, data []byte, _ string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *fsBlobStore) Get(_ context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s *fsBlobStore) Delete(_ context.Context, keys ...string) error {
+	for _, k := range keys {
+		p, err := s.path(k)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// mapRGB returns a copy of img with fn applied to every pixel's colour;
+// alpha is kept as is. fn works on 0..255 floats and may return values
+// out of range, which are clamped. fn is called from several goroutines.
+func mapRGB(img image.Image, fn func(r, g, b float64) (float64, float64, float64)) *image.NRGBA {
+	src := toNRGBA(img)
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	parallelRows(b.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			i := y * src.Stride
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl := fn(float64(src.Pix[i+0]), float64(src.Pix[i+1]), float64(src.Pix[i+2]))
+				dst.Pix[i+0] = clamp8(r)
+				dst.Pix[i+1] = clamp8(g)
+				dst.Pix[i+2] = clamp8(bl)
+				dst.Pix[i+3] = src.Pix[i+3]
+				i += 4
+			}
+		}
+	})
+	return dst
+}
+
+// applyLUT maps each colour channel through lut, which is cheaper than
+// mapRGB for adjustments that treat channels independently.
+func applyLUT(img image.Image, lut *[256]uint8) *image.NRGBA {
+	src := toNRGBA(img)
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	parallelRows(b.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			i := y * src.Stride
+			for x := b.Min.X; x < b.Max.X; x++ {
+				dst.Pix[i+0] = lut[src.Pix[i+0]]
+				dst.Pix[i+1] = lut[src.Pix[i+1]]
+				dst.Pix[i+2] = lut[src.Pix[i+2]]
+				dst.Pix[i+3] = src.Pix[i+3]
+				i += 4
+			}
+		}
+	})
+	return dst
+}
+
+func buildLUT(fn func(v float64) float64) *[256]uint8 {
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = clamp8(fn(float64(i)))
+	}
+	return &lut
+}
+
+func luma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+// brightnessOp shifts every channel by amount (-1..1) of full scale.
+func brightnessOp(img image.Image, p Params) (image.Image, error) {
+	d := p.Float("amount", 0) * 255
+	return applyLUT(img, buildLUT(func(v float64) float64 { return v + d })), nil
+}
+
+// contrastOp scales channels around mid-grey; amount -1 flattens the image
+// to grey, 0 is a no-op and 1 doubles the contrast.
+func contrastOp(img image.Image, p Params) (image.Image, error) {
+	f := 1 + p.Float("amount", 0)
+	return applyLUT(img, buildLUT(func(v float64) float64 { return (v-128)*f + 128 })), nil
+}
+
+// gammaOp applies gamma correction; values above 1 brighten midtones.
+func gammaOp(img image.Image, p Params) (image.Image, error) {
+	inv := 1 / p.Float("value", 1)
+	return applyLUT(img, buildLUT(func(v float64) float64 { return 255 * math.Pow(v/255, inv) })), nil
+}
+
+// saturationOp moves colours away from (amount > 0) or towards (amount < 0)
+// their luma; -1 yields grayscale.
+func saturationOp(img image.Image, p Params) (image.Image, error) {
+	f := 1 + p.Float("amount", 0)
+	return mapRGB(img, func(r, g, b float64) (float64, float64, float64) {
+		l := luma(r, g, b)
+		return l + (r-l)*f, l + (g-l)*f, l + (b-l)*f
+	}), nil
+}
+
+// hueOp rotates hue by degrees while preserving luma, using the same
+// matrix as the CSS hue-rotate() filter.
+func hueOp(img image.Image, p Params) (image.Image, error) {
+	rad := p.Float("degrees", 0) * math.Pi / 180
+	c, s := math.Cos(rad), math.Sin(rad)
+	m := [9]float64{
+		0.213 + c*0.787 - s*0.213, 0.715 - c*0.715 - s*0.715, 0.072 - c*0.072 + s*0.928,
+		0.213 - c*0.213 + s*0.143, 0.715 + c*0.285 + s*0.140, 0.072 - c*0.072 - s*0.283,
+		0.213 - c*0.213 - s*0.787, 0.715 - c*0.715 + s*0.715, 0.072 + c*0.928 + s*0.072,
+	}
+	return mapRGB(img, func(r, g, b float64) (float64, float64, float64) {
+		return m[0]*r + m[1]*g + m[2]*b, m[3]*r + m[4]*g + m[5]*b, m[6]*r + m[7]*g + m[8]*b
+	}), nil
+}
+
+// sepiaOp blends the image with its sepia tone by amount (0..1, default 1).
+func sepiaOp(img image.Image, p Params) (image.Image, error) {
+	a := p.Float("amount", 1)
+	return mapRGB(img, func(r, g, b float64) (float64, float64, float64) {
+		sr := 0.393*r + 0.769*g + 0.189*b
+		sg := 0.349*r + 0.686*g + 0.168*b
+		sb := 0.272*r + 0.534*g + 0.131*b
+		return r + (sr-r)*a, g + (sg-g)*a, b + (sb-b)*a
+	}), nil
+}
+
+// thresholdOp turns pixels white when their luma is at or above level and
+// black otherwise.
+func thresholdOp(img image.Image, p Params) (image.Image, error) {
+	level := p.Float("level", 128)
+	return mapRGB(img, func(r, g, b float64) (float64, float64, float64) {
+		if luma(r, g, b) >= level {
+			return 255, 255, 255
+		}
+		return 0, 0, 0
+	}), nil
+}
+
+// posterizeOp reduces every channel to the given number of evenly spaced
+// levels.
+func posterizeOp(img image.Image, p Params) (image.Image, error) {
+	n := float64(max(2, p.Int("levels", 4)) - 1)
+	return applyLUT(img, buildLUT(func(v float64) float64 {
+		return math.Round(v/255*n) * 255 / n
+	})), nil
+}
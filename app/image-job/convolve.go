@@ -0,0 +1,232 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// kernel is a 2D convolution matrix centred on (w/2, h/2). Width and
+// height must be odd.
+type kernel struct {
+	w, h int
+	data []float64
+}
+
+// planes holds an image as float channels so convolution passes can be
+// chained without rounding in between. When premul is set the colour
+// channels are multiplied by alpha (0..1).
+type planes struct {
+	w, h       int
+	r, g, b, a []float64
+	premul     bool
+}
+
+func newPlanes(w, h int) *planes {
+	n := w * h
+	return &planes{w: w, h: h, r: make([]float64, n), g: make([]float64, n), b: make([]float64, n), a: make([]float64, n)}
+}
+
+// toPlanes converts src to float channels. With premul set, colour is
+// weighted by alpha so transparent pixels do not bleed into their
+// neighbours when blurred.
+func toPlanes(src *image.NRGBA, premul bool) *planes {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	p := newPlanes(w, h)
+	p.premul = premul
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			i := y * src.Stride
+			for x := 0; x < w; x++ {
+				k := y*w + x
+				a := float64(src.Pix[i+3])
+				f := 1.0
+				if premul {
+					f = a / 255
+				}
+				p.r[k] = float64(src.Pix[i+0]) * f
+				p.g[k] = float64(src.Pix[i+1]) * f
+				p.b[k] = float64(src.Pix[i+2]) * f
+				p.a[k] = a
+				i += 4
+			}
+		}
+	})
+	return p
+}
+
+func (p *planes) toNRGBA() *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, p.w, p.h))
+	parallelRows(p.h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			i := y * dst.Stride
+			for x := 0; x < p.w; x++ {
+				k := y*p.w + x
+				a := p.a[k]
+				f := 1.0
+				if p.premul {
+					if a <= 0 {
+						i += 4
+						continue
+					}
+					f = 255 / a
+				}
+				dst.Pix[i+0] = clamp8(p.r[k] * f)
+				dst.Pix[i+1] = clamp8(p.g[k] * f)
+				dst.Pix[i+2] = clamp8(p.b[k] * f)
+				dst.Pix[i+3] = clamp8(a)
+				i += 4
+			}
+		}
+	})
+	return dst
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// convolve applies k to every channel in chans (at most four). Pixels
+// outside the image repeat the nearest edge pixel, so borders neither
+// darken nor fade out.
+func convolve(p *planes, k kernel, chans ...[]float64) [][]float64 {
+	out := make([][]float64, len(chans))
+	for c := range chans {
+		out[c] = make([]float64, len(chans[c]))
+	}
+	cx, cy := k.w/2, k.h/2
+	parallelRows(p.h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < p.w; x++ {
+				var sums [4]float64
+				for ky := 0; ky < k.h; ky++ {
+					sy := clampInt(y+ky-cy, 0, p.h-1)
+					for kx := 0; kx < k.w; kx++ {
+						wt := k.data[ky*k.w+kx]
+						if wt == 0 {
+							continue
+						}
+						si := sy*p.w + clampInt(x+kx-cx, 0, p.w-1)
+						for c, ch := range chans {
+							sums[c] += ch[si] * wt
+						}
+					}
+				}
+				for c := range chans {
+					out[c][y*p.w+x] = sums[c]
+				}
+			}
+		}
+	})
+	return out
+}
+
+// convolveSeparable runs the 1D kernel k horizontally and then vertically,
+// which costs 2n instead of n² multiplications per pixel.
+func convolveSeparable(p *planes, k []float64, chans ...[]float64) [][]float64 {
+	h := kernel{w: len(k), h: 1, data: k}
+	v := kernel{w: 1, h: len(k), data: k}
+	return convolve(p, v, convolve(p, h, chans...)...)
+}
+
+// gaussianKernel returns a normalised 1D Gaussian of the given radius.
+func gaussianKernel(radius int, sigma float64) []float64 {
+	k := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range k {
+		x := float64(i - radius)
+		k[i] = math.Exp(-(x * x) / (2 * sigma * sigma))
+		sum += k[i]
+	}
+	for i := range k {
+		k[i] /= sum
+	}
+	return k
+}
+
+// gaussianParams reads sigma and radius; a missing radius covers 3 sigma.
+func gaussianParams(p Params, defSigma float64) (int, float64) {
+	sigma := p.Float("sigma", defSigma)
+	if sigma <= 0 {
+		sigma = defSigma
+	}
+	radius := p.Int("radius", int(math.Ceil(3*sigma)))
+	return max(1, radius), sigma
+}
+
+func gaussianBlur(src *image.NRGBA, radius int, sigma float64) *planes {
+	p := toPlanes(src, true)
+	out := convolveSeparable(p, gaussianKernel(radius, sigma), p.r, p.g, p.b, p.a)
+	p.r, p.g, p.b, p.a = out[0], out[1], out[2], out[3]
+	return p
+}
+
+// blurOp applies a Gaussian blur, alpha included.
+func blurOp(img image.Image, p Params) (image.Image, error) {
+	radius, sigma := gaussianParams(p, 2)
+	return gaussianBlur(toNRGBA(img), radius, sigma).toNRGBA(), nil
+}
+
+// sharpenOp is an unsharp mask: the difference between the image and its
+// blur is scaled by amount and added back, skipping differences at or
+// below threshold so flat areas do not gain noise.
+func sharpenOp(img image.Image, p Params) (image.Image, error) {
+	src := toNRGBA(img)
+	radius, sigma := gaussianParams(p, 1)
+	amount := p.Float("amount", 1)
+	threshold := p.Float("threshold", 0)
+
+	orig := toPlanes(src, false)
+	blur := gaussianBlur(src, radius, sigma).toNRGBA()
+	bl := toPlanes(blur, false)
+	for _, ch := range [][2][]float64{{orig.r, bl.r}, {orig.g, bl.g}, {orig.b, bl.b}} {
+		o, b := ch[0], ch[1]
+		for i := range o {
+			if d := o[i] - b[i]; math.Abs(d) > threshold {
+				o[i] += amount * d
+			}
+		}
+	}
+	return orig.toNRGBA(), nil
+}
+
+var (
+	sobelX = kernel{3, 3, []float64{-1, 0, 1, -2, 0, 2, -1, 0, 1}}
+	sobelY = kernel{3, 3, []float64{-1, -2, -1, 0, 0, 0, 1, 2, 1}}
+)
+
+// edgeOp runs Sobel edge detection on luminance and returns the gradient
+// magnitude as a grayscale image with the source alpha.
+func edgeOp(img image.Image, _ Params) (image.Image, error) {
+	p := toPlanes(toNRGBA(img), false)
+	lum := make([]float64, len(p.r))
+	for i := range lum {
+		lum[i] = 0.299*p.r[i] + 0.587*p.g[i] + 0.114*p.b[i]
+	}
+	gx := convolve(p, sobelX, lum)[0]
+	gy := convolve(p, sobelY, lum)[0]
+	for i := range lum {
+		m := math.Hypot(gx[i], gy[i]) / 4
+		p.r[i], p.g[i], p.b[i] = m, m, m
+	}
+	return p.toNRGBA(), nil
+}
+
+// embossOp shades the image as if lit from the top left. strength scales
+// the relief; the result is centred on mid-grey and keeps source alpha.
+func embossOp(img image.Image, p Params) (image.Image, error) {
+	s := p.Float("strength", 1)
+	k := kernel{3, 3, []float64{-2 * s, -s, 0, -s, 0, s, 0, s, 2 * s}}
+	pl := toPlanes(toNRGBA(img), false)
+	out := convolve(pl, k, pl.r, pl.g, pl.b)
+	for i := range pl.r {
+		v := 128 + 0.299*out[0][i] + 0.587*out[1][i] + 0.114*out[2][i]
+		pl.r[i], pl.g[i], pl.b[i] = v, v, v
+	}
+	return pl.toNRGBA(), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+)
+
+// Op is one step of an effect pipeline as sent by the API.
+type Op struct {
+	Name   string `json:"op"`
+	Params Params `json:"params,omitempty"`
+}
+
+// Params holds an op's parameters as decoded from JSON.
+type Params map[string]any
+
+func (p Params) Float(name string, def float64) float64 {
+	if f, ok := p[name].(float64); ok {
+		return f
+	}
+	return def
+}
+
+func (p Params) Int(name string, def int) int {
+	if f, ok := p[name].(float64); ok {
+		return int(f)
+	}
+	return def
+}
+
+func (p Params) String(name, def string) string {
+	if s, ok := p[name].(string); ok && s != "" {
+		return strings.ToLower(s)
+	}
+	return def
+}
+
+func (p Params) Bool(name string, def bool) bool {
+	if b, ok := p[name].(bool); ok {
+		return b
+	}
+	return def
+}
+
+type effectFunc func(img image.Image, p Params) (image.Image, error)
+
+// effects is the registry of supported ops. Keep in sync with the catalog
+// in app/api/effects.go.
+var effects = map[string]effectFunc{
+	"grayscale": func(img image.Image, _ Params) (image.Image, error) { return toGrayscale(img), nil },
+	"invert":    func(img image.Image, _ Params) (image.Image, error) { return invertColors(img), nil },
+	"resize":    resizeOp,
+	"crop":      cropOp,
+	"rotate":    rotateOp,
+	"flip":      flipOp,
+	"blur":      blurOp,
+	"sharpen":   sharpenOp,
+	"edge":      edgeOp,
+	"emboss":    embossOp,
+
+	"brightness": brightnessOp,
+	"contrast":   contrastOp,
+	"gamma":      gammaOp,
+	"saturation": saturationOp,
+	"hue":        hueOp,
+	"sepia":      sepiaOp,
+	"threshold":  thresholdOp,
+	"posterize":  posterizeOp,
+}
+
+func effectNames() string {
+	names := make([]string, 0, len(effects))
+	for n := range effects {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " | ")
+}
+
+// parsePipeline decodes a JSON pipeline spec and checks every op is known.
+func parsePipeline(spec string) ([]Op, error) {
+	var ops []Op
+	if err := json.Unmarshal([]byte(spec), &ops); err != nil {
+		return nil, fmt.Errorf("decode pipeline: %w", err)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("pipeline is empty")
+	}
+	for i := range ops {
+		ops[i].Name = strings.ToLower(strings.TrimSpace(ops[i].Name))
+		if _, ok := effects[ops[i].Name]; !ok {
+			return nil, fmt.Errorf("step %d: unsupported effect %q (use: %s)", i, ops[i].Name, effectNames())
+		}
+	}
+	return ops, nil
+}
+
+// runPipeline applies ops in order, each to the previous step's output.
+func runPipeline(img image.Image, ops []Op) (image.Image, error) {
+	for i, op := range ops {
+		out, err := effects[op.Name](img, op.Params)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i, op.Name, err)
+		}
+		img = out
+	}
+	return img, nil
+}
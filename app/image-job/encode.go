@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"sort"
+)
+
+const defaultJPEGQuality = 90
+
+// outputFormat picks the encoder: an explicit request wins, otherwise the
+// source format is kept when we can encode it, falling back to PNG.
+func outputFormat(requested, source string) string {
+	switch requested {
+	case "png", "jpeg", "gif":
+		return requested
+	case "jpg":
+		return "jpeg"
+	}
+	switch source {
+	case "jpeg", "gif":
+		return source
+	}
+	return "png"
+}
+
+// encodeImage encodes img as format and returns the bytes and content type.
+// quality applies to JPEG only; 0 selects the default.
+func encodeImage(img image.Image, format string, quality int) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if quality <= 0 || quality > 100 {
+			quality = defaultJPEGQuality
+		}
+		if err := jpeg.Encode(&buf, flattenAlpha(img, color.White), &jpeg.Options{Quality: quality}); err != nil {
+			return nil, "", fmt.Errorf("jpeg encode: %w", err)
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	case "gif":
+		opts := &gif.Options{NumColors: 256, Quantizer: medianCut{}, Drawer: draw.FloydSteinberg}
+		if err := gif.Encode(&buf, img, opts); err != nil {
+			return nil, "", fmt.Errorf("gif encode: %w", err)
+		}
+		return buf.Bytes(), "image/gif", nil
+	case "png":
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", fmt.Errorf("png encode: %w", err)
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+	return nil, "", fmt.Errorf("unsupported output format %q", format)
+}
+
+// flattenAlpha composites img over bg, since JPEG has no alpha channel and
+// would otherwise turn transparent areas black.
+func flattenAlpha(img image.Image, bg color.Color) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// medianCut is a draw.Quantizer that builds a palette by repeatedly
+// splitting the colour box with the widest channel range at its median.
+// Mostly transparent pixels are left out and get a dedicated entry.
+type medianCut struct{}
+
+// quantizeSamples caps how many pixels feed the palette search; large
+// images are sampled on a regular grid.
+const quantizeSamples = 1 << 16
+
+type colorBox struct {
+	pixels []color.NRGBA
+	ch     int   // channel with the widest range
+	span   uint8 // that range
+}
+
+func newColorBox(px []color.NRGBA) colorBox {
+	b := colorBox{pixels: px}
+	b.ch, b.span = b.widest()
+	return b
+}
+
+func (b colorBox) widest() (int, uint8) {
+	lo := [3]uint8{255, 255, 255}
+	hi := [3]uint8{}
+	for _, c := range b.pixels {
+		for i, v := range [3]uint8{c.R, c.G, c.B} {
+			lo[i] = min(lo[i], v)
+			hi[i] = max(hi[i], v)
+		}
+	}
+	ch, span := 0, uint8(0)
+	for i := range lo {
+		if hi[i]-lo[i] > span {
+			ch, span = i, hi[i]-lo[i]
+		}
+	}
+	return ch, span
+}
+
+func (b colorBox) mean() color.NRGBA {
+	var r, g, bl int
+	for _, c := range b.pixels {
+		r += int(c.R)
+		g += int(c.G)
+		bl += int(c.B)
+	}
+	n := len(b.pixels)
+	return color.NRGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 255}
+}
+
+func (medianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	src := toNRGBA(m)
+	bounds := src.Bounds()
+	limit := cap(p) - len(p)
+	step := 1
+	for (bounds.Dx()/step)*(bounds.Dy()/step) > quantizeSamples {
+		step++
+	}
+	var opaque []color.NRGBA
+	transparent := false
+	for y := 0; y < bounds.Dy(); y += step {
+		for x := 0; x < bounds.Dx(); x += step {
+			i := y*src.Stride + x*4
+			c := color.NRGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}
+			if c.A < 128 {
+				transparent = true
+			} else {
+				opaque = append(opaque, c)
+			}
+		}
+	}
+	if transparent {
+		p = append(p, color.NRGBA{})
+		limit--
+	}
+	if len(opaque) == 0 || limit <= 0 {
+		return p
+	}
+
+	boxes := []colorBox{newColorBox(opaque)}
+	for len(boxes) < limit {
+		best := -1
+		for i, b := range boxes {
+			if len(b.pixels) >= 2 && b.span > 0 && (best < 0 || b.span > boxes[best].span) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		px, ch := boxes[best].pixels, boxes[best].ch
+		sort.Slice(px, func(i, j int) bool { return channel(px[i], ch) < channel(px[j], ch) })
+		mid := len(px) / 2
+		boxes[best] = newColorBox(px[:mid])
+		boxes = append(boxes, newColorBox(px[mid:]))
+	}
+	for _, b := range boxes {
+		p = append(p, b.mean())
+	}
+	return p
+}
+
+func channel(c color.NRGBA, ch int) uint8 {
+	switch ch {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	}
+	return c.B
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when
+// there is none or the EXIF block cannot be read.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			break
+		}
+		payload := data[i+4 : i+2+n]
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return tiffOrientation(payload[6:])
+		}
+		i += 2 + n
+	}
+	return 1
+}
+
+func tiffOrientation(b []byte) int {
+	if len(b) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder
+	switch string(b[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	off := int(bo.Uint32(b[4:]))
+	if off < 8 || off+2 > len(b) {
+		return 1
+	}
+	n := int(bo.Uint16(b[off:]))
+	for k := 0; k < n; k++ {
+		e := off + 2 + 12*k
+		if e+12 > len(b) {
+			break
+		}
+		if bo.Uint16(b[e:]) == 0x0112 && bo.Uint16(b[e+2:]) == 3 {
+			if o := int(bo.Uint16(b[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// orientNRGBA returns img rotated and flipped so that it displays upright
+// for EXIF orientation o. Orientations 5-8 swap width and height.
+func orientNRGBA(img image.Image, o int) *image.NRGBA {
+	src := toNRGBA(img)
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	parallelRows(dh, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < dw; x++ {
+				sx, sy := x, y
+				switch o {
+				case 2:
+					sx = w - 1 - x
+				case 3:
+					sx, sy = w-1-x, h-1-y
+				case 4:
+					sy = h - 1 - y
+				case 5:
+					sx, sy = y, x
+				case 6:
+					sx, sy = y, h-1-x
+				case 7:
+					sx, sy = w-1-y, h-1-x
+				case 8:
+					sx, sy = w-1-y, x
+				}
+				si := src.PixOffset(b.Min.X+sx, b.Min.Y+sy)
+				copy(dst.Pix[y*dst.Stride+x*4:], src.Pix[si:si+4])
+			}
+		}
+	})
+	return dst
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// decodeGIFFrames decodes every frame of a GIF and composites each onto the
+// logical screen, honouring the previous frame's disposal method, so the
+// returned images are exactly what a viewer shows at each step.
+func decodeGIFFrames(data []byte) (*gif.GIF, []*image.NRGBA, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("gif decode: %w", err)
+	}
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if screen.Empty() && len(g.Image) > 0 {
+		screen = g.Image[0].Bounds()
+	}
+	canvas := image.NewNRGBA(screen)
+	frames := make([]*image.NRGBA, 0, len(g.Image))
+	for i, fr := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var saved *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			saved = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, fr.Bounds(), fr, fr.Bounds().Min, draw.Over)
+		frames = append(frames, cloneNRGBA(canvas))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			// Browsers clear to transparent rather than the background colour.
+			draw.Draw(canvas, fr.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+	return g, frames, nil
+}
+
+// animatedGIF returns the decoded animation and its composited frames when
+// data is a GIF with more than one frame, and nil otherwise.
+func animatedGIF(data []byte, format string) (*gif.GIF, []*image.NRGBA, error) {
+	if format != "gif" {
+		return nil, nil, nil
+	}
+	g, frames, err := decodeGIFFrames(data)
+	if err != nil || len(frames) < 2 {
+		return nil, nil, err
+	}
+	return g, frames, nil
+}
+
+func cloneNRGBA(src *image.NRGBA) *image.NRGBA {
+	dst := image.NewNRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// runFrames runs ops on every frame of an animation.
+func runFrames(frames []*image.NRGBA, ops []Op) ([]image.Image, error) {
+	out := make([]image.Image, len(frames))
+	for i, fr := range frames {
+		img, err := runPipeline(fr, ops)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		out[i] = img
+	}
+	return out, nil
+}
+
+// encodeAnimatedGIF encodes frames with the delays and loop count of g.
+// Frames are full composites, so each is disposed to background before
+// the next.
+func encodeAnimatedGIF(g *gif.GIF, frames []image.Image) ([]byte, error) {
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	for i, img := range frames {
+		b := img.Bounds()
+		if i == 0 {
+			out.Config = image.Config{Width: b.Dx(), Height: b.Dy()}
+		}
+		p := image.NewPaletted(b, medianCut{}.Quantize(make(color.Palette, 0, 256), img))
+		draw.FloydSteinberg.Draw(p, b, img, b.Min)
+		out.Image = append(out.Image, p)
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, fmt.Errorf("gif encode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
-	"image/png"
 	_ "image/png"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,17 +21,51 @@ func main() {
 		redisAddr = getenv("REDIS_ADDR", "redis:6379")
 		imageID   = getenv("IMAGE_ID", "")
 		effect    = strings.ToLower(getenv("EFFECT", ""))
+		spec      = getenv("PIPELINE", "")
+		variant   = strings.ToLower(getenv("VARIANT", ""))
+		format    = strings.ToLower(getenv("OUTPUT_FORMAT", ""))
+		quality   = getenv("OUTPUT_QUALITY", "")
+		thumbs    = getenv("THUMB_WIDTHS", defaultThumbWidths)
 	)
 	flag.StringVar(&redisAddr, "redis", redisAddr, "Redis host:port")
 	flag.StringVar(&imageID, "id", imageID, "Image ID (required)")
-	flag.StringVar(&effect, "effect", effect, "Effect: grayscale | invert (required)")
+	flag.StringVar(&effect, "effect", effect, "Single effect, shorthand for a one-step pipeline")
+	flag.StringVar(&spec, "pipeline", spec, `Pipeline JSON, e.g. [{"op":"grayscale"},{"op":"invert"}]`)
+	flag.StringVar(&variant, "variant", variant, "Variant name to store the result under (default: op names joined by +)")
+	flag.StringVar(&format, "format", format, "Output format: png | jpeg | gif (default: same as source)")
+	flag.StringVar(&quality, "quality", quality, "JPEG quality 1-100 (default 90)")
+	flag.StringVar(&thumbs, "thumbs", thumbs, "Comma-separated thumbnail widths to render for the variant")
+	flag.IntVar(&workers, "workers", workers, "Goroutines used for pixel work (default: CPU limit)")
 	flag.Parse()
 
-	if imageID == "" || effect == "" {
-		log.Fatalf("[fatal] IMAGE_ID and EFFECT are required (got id=%q effect=%q)", imageID, effect)
+	log.Printf("[info] using %d workers", workers)
+
+	if imageID == "" || (effect == "" && spec == "") {
+		log.Fatalf("[fatal] IMAGE_ID and PIPELINE or EFFECT are required (got id=%q effect=%q pipeline=%q)", imageID, effect, spec)
+	}
+	if spec == "" {
+		spec = fmt.Sprintf(`[{"op":%q}]`, effect)
+	}
+	ops, err := parsePipeline(spec)
+	if err != nil {
+		log.Fatalf("[fatal] %v", err)
+	}
+	q := 0
+	if quality != "" {
+		if q, err = strconv.Atoi(quality); err != nil || q < 0 || q > 100 {
+			log.Fatalf("[fatal] invalid quality %q", quality)
+		}
 	}
-	if effect != "grayscale" && effect != "invert" {
-		log.Fatalf("[fatal] unsupported effect %q (use: grayscale | invert)", effect)
+	widths, err := parseWidths(thumbs)
+	if err != nil {
+		log.Fatalf("[fatal] %v", err)
+	}
+	if variant == "" {
+		names := make([]string, len(ops))
+		for i, op := range ops {
+			names[i] = op.Name
+		}
+		variant = strings.Join(names, "+")
 	}
 
 	rdb, err := NewRedisClient(redisAddr)
@@ -39,49 +74,98 @@ func main() {
 	}
 	defer rdb.Close()
 
+	blobCfg := blobConfigFromEnv()
+	blobs, err := NewBlobStore(blobCfg, rdb)
+	if err != nil {
+		log.Fatalf("[fatal] blob store: %v", err)
+	}
+	log.Printf("[info] blob store=%s", blobCfg.Backend)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	// The original upload is never overwritten; each pipeline writes its own
+	// variant and becomes the active one.
 	key := "image:" + imageID
-	ctypeKey := "image:ctype:" + imageID
+	outKey := key + ":v:" + variant
+	ctypeKey := "image:ctype:" + imageID + ":v:" + variant
+	sizesKey := "image:sizes:" + imageID + ":v:" + variant
 
-	srcBytes, err := rdb.GetBytes(ctx, key)
+	srcBytes, err := blobs.Get(ctx, key)
 	if err != nil {
 		log.Fatalf("[fatal] get %s: %v", key, err)
 	}
 	log.Printf("[info] loaded image bytes=%d", len(srcBytes))
 
-	srcImg, format, err := image.Decode(bytes.NewReader(srcBytes))
+	srcImg, srcFormat, err := image.Decode(bytes.NewReader(srcBytes))
 	if err != nil {
 		log.Fatalf("[fatal] decode: %v", err)
 	}
-	log.Printf("[info] decoded format=%s bounds=%v", format, srcImg.Bounds())
-
-	var outImg image.Image
-	switch effect {
-	case "grayscale":
-		outImg = toGrayscale(srcImg)
-	case "invert":
-		outImg = invertColors(srcImg)
-	default:
-		log.Fatalf("[fatal] unreachable effect %q", effect)
+	log.Printf("[info] decoded format=%s bounds=%v", srcFormat, srcImg.Bounds())
+	if srcFormat == "jpeg" {
+		// Effects work on the image as displayed, so undo EXIF rotation
+		// first; the encoders write no EXIF, so the result stays upright.
+		if o := jpegOrientation(srcBytes); o > 1 {
+			log.Printf("[info] applying exif orientation=%d", o)
+			srcImg = orientNRGBA(srcImg, o)
+		}
 	}
 
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, outImg); err != nil {
-		log.Fatalf("[fatal] png encode: %v", err)
+	outFormat := outputFormat(format, srcFormat)
+	var (
+		out   []byte
+		ctype string
+	)
+	anim, frames, err := animatedGIF(srcBytes, srcFormat)
+	if err != nil {
+		log.Fatalf("[fatal] %v", err)
+	}
+	// outFrames holds the processed animation, or just the still result.
+	var outFrames []image.Image
+	if anim != nil && outFormat == "gif" {
+		log.Printf("[info] animated gif frames=%d loop=%d", len(frames), anim.LoopCount)
+		if outFrames, err = runFrames(frames, ops); err == nil {
+			out, err = encodeAnimatedGIF(anim, outFrames)
+			ctype = "image/gif"
+		}
+	} else {
+		if anim != nil {
+			// Still formats get the first frame as it is displayed.
+			srcImg, anim = frames[0], nil
+		}
+		var outImg image.Image
+		if outImg, err = runPipeline(srcImg, ops); err == nil {
+			outFrames = []image.Image{outImg}
+			out, ctype, err = encodeImage(outImg, outFormat, q)
+		}
+	}
+	if err != nil {
+		log.Fatalf("[fatal] %v", err)
+	}
+	small, err := renderThumbnails(outFrames, anim, outFormat, q, widths)
+	if err != nil {
+		log.Fatalf("[fatal] %v", err)
 	}
 
-	if err := rdb.Set(ctx, key, buf.Bytes(), 0); err != nil {
-		log.Fatalf("[fatal] set %s: %v", key, err)
+	if err := blobs.Put(ctx, outKey, out, ctype); err != nil {
+		log.Fatalf("[fatal] set %s: %v", outKey, err)
 	}
-	if err := rdb.Set(ctx, ctypeKey, []byte("image/png"), 0); err != nil {
+	if err := rdb.Set(ctx, ctypeKey, []byte(ctype), 0); err != nil {
 		log.Fatalf("[fatal] set %s: %v", ctypeKey, err)
 	}
+	if err := rdb.HSet(ctx, blobInfoKey(outKey), blobInfo(out)); err != nil {
+		log.Fatalf("[fatal] set %s: %v", blobInfoKey(outKey), err)
+	}
+	if err := storeThumbnails(ctx, rdb, blobs, outKey, ctypeKey, sizesKey, outFrames[0].Bounds(), small); err != nil {
+		log.Fatalf("[fatal] store thumbnails: %v", err)
+	}
 
-	_ = rdb.Set(ctx, "image:fx:"+imageID, []byte(effect), 0)
+	if err := rdb.SAdd(ctx, "image:variants:"+imageID, variant); err != nil {
+		log.Fatalf("[fatal] sadd variants: %v", err)
+	}
+	_ = rdb.Set(ctx, "image:fx:"+imageID, []byte(variant), 0)
 
-	log.Printf("[done] effect=%s wrote %d bytes to %s (ctype=image/png)", effect, buf.Len(), key)
+	log.Printf("[done] variant=%s steps=%d wrote %d bytes to %s (ctype=%s, thumbnails=%d)", variant, len(ops), len(out), outKey, ctype, len(small))
 }
 
 func getenv(k, def string) string {
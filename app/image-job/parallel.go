@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// workers is the number of goroutines used for pixel work. It defaults to
+// the CPUs the container may actually use and can be set with WORKERS.
+var workers = detectWorkers()
+
+// minRowsPerBand keeps bands large enough that scheduling overhead does not
+// eat the gain on small images.
+const minRowsPerBand = 16
+
+func detectWorkers() int {
+	if s := os.Getenv("WORKERS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			return n
+		}
+	}
+	n := runtime.GOMAXPROCS(0)
+	if q, ok := cgroupCPUQuota(); ok {
+		n = min(n, max(1, int(math.Ceil(q))))
+	}
+	return n
+}
+
+// cgroupCPUQuota returns the container's CPU limit in cores, reading the
+// cgroup v2 cpu.max file or falling back to the v1 CFS quota.
+func cgroupCPUQuota() (float64, bool) {
+	if b, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) == 2 && f[0] != "max" {
+			quota, err1 := strconv.ParseFloat(f[0], 64)
+			period, err2 := strconv.ParseFloat(f[1], 64)
+			if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+				return quota / period, true
+			}
+		}
+		return 0, false
+	}
+	qb, err1 := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	pb, err2 := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	quota, err1 := strconv.ParseFloat(strings.TrimSpace(string(qb)), 64)
+	period, err2 := strconv.ParseFloat(strings.TrimSpace(string(pb)), 64)
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0, false
+	}
+	return quota / period, true
+}
+
+// parallelRows splits [0, h) into contiguous bands and calls fn(y0, y1) for
+// each on up to workers goroutines. Calls for different bands must write
+// disjoint output, which makes the result identical to a single fn(0, h).
+func parallelRows(h int, fn func(y0, y1 int)) {
+	n := min(workers, h/minRowsPerBand)
+	if n <= 1 {
+		fn(0, h)
+		return
+	}
+	// More bands than workers evens out bands that finish early.
+	bands := n * 4
+	size := (h + bands - 1) / bands
+	next := make(chan int, bands)
+	for y := 0; y < h; y += size {
+		next <- y
+	}
+	close(next)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y0 := range next {
+				fn(y0, min(y0+size, h))
+			}
+		}()
+	}
+	wg.Wait()
+}
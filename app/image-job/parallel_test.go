@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"testing"
+)
+
+// benchOps is the set of effects compared serial against parallel.
+var benchOps = []Op{
+	{Name: "grayscale"},
+	{Name: "invert"},
+	{Name: "sepia"},
+	{Name: "hue", Params: Params{"degrees": 90.0}},
+	{Name: "resize", Params: Params{"width": 1024.0, "filter": "lanczos"}},
+	{Name: "rotate", Params: Params{"angle": 17.0}},
+	{Name: "blur", Params: Params{"sigma": 3.0}},
+	{Name: "sharpen", Params: Params{"amount": 1.5}},
+	{Name: "edge"},
+}
+
+// synthImage returns a w x h image with varied colour and alpha.
+func synthImage(w, h int) *image.NRGBA {
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*src.Stride + x*4
+			src.Pix[i+0] = uint8(x ^ y)
+			src.Pix[i+1] = uint8(x * 7)
+			src.Pix[i+2] = uint8(y * 3)
+			src.Pix[i+3] = uint8(255 - (x+y)%64)
+		}
+	}
+	return src
+}
+
+// withWorkers runs fn with the worker count set to n.
+func withWorkers(n int, fn func()) {
+	saved := workers
+	defer func() { workers = saved }()
+	workers = n
+	fn()
+}
+
+func runOp(tb testing.TB, src *image.NRGBA, op Op) *image.NRGBA {
+	tb.Helper()
+	out, err := runPipeline(src, []Op{op})
+	if err != nil {
+		tb.Fatalf("%s: %v", op.Name, err)
+	}
+	return toNRGBA(out)
+}
+
+// TestParallelMatchesSerial checks that splitting the pixel work across
+// goroutines changes nothing in the output. The odd size leaves uneven
+// bands.
+func TestParallelMatchesSerial(t *testing.T) {
+	src := synthImage(301, 217)
+	for _, op := range benchOps {
+		t.Run(op.Name, func(t *testing.T) {
+			var serial, par *image.NRGBA
+			withWorkers(1, func() { serial = runOp(t, src, op) })
+			withWorkers(7, func() { par = runOp(t, src, op) })
+			if serial.Rect != par.Rect {
+				t.Fatalf("bounds differ: serial %v, parallel %v", serial.Rect, par.Rect)
+			}
+			if !bytes.Equal(serial.Pix, par.Pix) {
+				t.Fatal("parallel output differs from serial")
+			}
+		})
+	}
+}
+
+// BenchmarkEffects times each effect on a 4000x3000 image, on one
+// goroutine and with the default worker count (set WORKERS to compare).
+func BenchmarkEffects(b *testing.B) {
+	src := synthImage(4000, 3000)
+	counts := []int{1}
+	if workers > 1 {
+		counts = append(counts, workers)
+	}
+	for _, op := range benchOps {
+		for _, n := range counts {
+			b.Run(fmt.Sprintf("%s/workers=%d", op.Name, n), func(b *testing.B) {
+				withWorkers(n, func() {
+					for range b.N {
+						runOp(b, src, op)
+					}
+				})
+			})
+		}
+	}
+}
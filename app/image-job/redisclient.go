@@ -100,6 +100,15 @@ func (c *RedisClient) Set(ctx context.Context, key string, value []byte, ttlSeco
 	return err
 }
 
+func (c *RedisClient) SAdd(ctx context.Context, key string, members ...string) error {
+	args := []any{key}
+	for _, m := range members {
+		args = append(args, m)
+	}
+	_, err := c.do(ctx, "SADD", args...)
+	return err
+}
+
 func (c *RedisClient) GetBytes(ctx context.Context, key string) ([]byte, error) {
 	v, err := c.do(ctx, "GET", key)
 	if err != nil {
@@ -135,6 +144,15 @@ func (c *RedisClient) Exists(ctx context.Context, key string) (int64, error) {
 	return n, nil
 }
 
+func (c *RedisClient) Del(ctx context.Context, keys ...string) error {
+	args := make([]any, len(keys))
+	for i, k := range keys {
+		args[i] = k
+	}
+	_, err := c.do(ctx, "DEL", args...)
+	return err
+}
+
 func (c *RedisClient) do(ctx context.Context, cmd string, args ...any) (any, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/gif"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultThumbWidths matches the API's default THUMB_WIDTHS.
+const defaultThumbWidths = "128,512,1024"
+
+// thumb is one downscaled rendition of the job's output.
+type thumb struct {
+	width, height int
+	data          []byte
+	ctype         string
+}
+
+// parseWidths parses a comma-separated list of positive widths, sorted.
+func parseWidths(s string) ([]int, error) {
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid thumbnail width %q", f)
+		}
+		out = append(out, n)
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// renderThumbnails scales the output to each width narrower than it and
+// encodes it like the output itself. frames holds every frame when anim is
+// set, so animated variants keep animated thumbnails.
+func renderThumbnails(frames []image.Image, anim *gif.GIF, format string, quality int, widths []int) ([]thumb, error) {
+	b := frames[0].Bounds()
+	lanczos := resampleFilters["lanczos"]
+	var out []thumb
+	for _, w := range widths {
+		if w >= b.Dx() {
+			break
+		}
+		h := max(1, (b.Dy()*w+b.Dx()/2)/b.Dx())
+		scaled := make([]image.Image, len(frames))
+		for i, f := range frames {
+			scaled[i] = resizeFiltered(toNRGBA(f), w, h, lanczos)
+		}
+		t := thumb{width: w, height: h}
+		var err error
+		if anim != nil {
+			t.data, err = encodeAnimatedGIF(anim, scaled)
+			t.ctype = "image/gif"
+		} else {
+			t.data, t.ctype, err = encodeImage(scaled[0], format, quality)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%dpx thumbnail: %w", w, err)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// storeThumbnails writes the thumbnails of the variant whose blob is key,
+// records every available size, full size included, in sizesKey and drops
+// thumbnails of widths no longer rendered.
+func storeThumbnails(ctx context.Context, rdb *RedisClient, blobs BlobStore, key, ctypeKey, sizesKey string, full image.Rectangle, thumbs []thumb) error {
+	old, err := rdb.HGetAll(ctx, sizesKey)
+	if err != nil {
+		return err
+	}
+	sizes := map[string]any{strconv.Itoa(full.Dx()): full.Dy()}
+	for _, t := range thumbs {
+		w := strconv.Itoa(t.width)
+		if err := blobs.Put(ctx, key+":w:"+w, t.data, t.ctype); err != nil {
+			return err
+		}
+		if err := rdb.Set(ctx, ctypeKey+":w:"+w, []byte(t.ctype), 0); err != nil {
+			return err
+		}
+		if err := rdb.HSet(ctx, blobInfoKey(key+":w:"+w), blobInfo(t.data)); err != nil {
+			return err
+		}
+		sizes[w] = t.height
+	}
+	var staleBlobs, staleMeta []string
+	for w := range old {
+		if _, ok := sizes[w]; !ok {
+			staleBlobs = append(staleBlobs, key+":w:"+w)
+			staleMeta = append(staleMeta, ctypeKey+":w:"+w, blobInfoKey(key+":w:"+w))
+		}
+	}
+	if err := rdb.Del(ctx, sizesKey); err != nil {
+		return err
+	}
+	if err := rdb.HSet(ctx, sizesKey, sizes); err != nil {
+		return err
+	}
+	if len(staleMeta) > 0 {
+		if err := rdb.Del(ctx, staleMeta...); err != nil {
+			return err
+		}
+	}
+	return blobs.Delete(ctx, staleBlobs...)
+}
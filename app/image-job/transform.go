@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// maxImageSide and maxImagePixels bound the images resize may produce. They
+// match the API's limits on requested sizes and uploads; a requested side
+// within bounds can still imply a huge other side once the aspect ratio is
+// applied, so the computed size is checked before anything is allocated.
+const (
+	maxImageSide   = 8192
+	maxImagePixels = 40_000_000
+)
+
+// checkResizeSize rejects a resize to w x h from a source sh rows tall.
+// resizeFiltered holds a w x sh intermediate, so that is bounded too.
+func checkResizeSize(w, h, sh int) error {
+	if w > maxImageSide || h > maxImageSide {
+		return fmt.Errorf("resize to %dx%d exceeds the %d pixel side limit", w, h, maxImageSide)
+	}
+	if w*h > maxImagePixels || w*sh > maxImagePixels {
+		return fmt.Errorf("resize to %dx%d exceeds the %d pixel limit", w, h, maxImagePixels)
+	}
+	return nil
+}
+
+// resampleFilter is a separable reconstruction kernel with the given
+// support radius (in source pixels at scale 1).
+type resampleFilter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+var resampleFilters = map[string]resampleFilter{
+	"bilinear": {1, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1 - x
+		}
+		return 0
+	}},
+	"catmullrom": {2, func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x < 1:
+			return (1.5*x-2.5)*x*x + 1
+		case x < 2:
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+		return 0
+	}},
+	"lanczos": {3, func(x float64) float64 {
+		x = math.Abs(x)
+		if x == 0 {
+			return 1
+		}
+		if x < 3 {
+			px := math.Pi * x
+			return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+		}
+		return 0
+	}},
+}
+
+// resizeOp scales the image. With only width or height set the other side
+// follows the aspect ratio. mode=fit keeps the whole image inside the box,
+// fill covers the box and centre-crops the overflow, stretch ignores aspect.
+func resizeOp(img image.Image, p Params) (image.Image, error) {
+	src := toNRGBA(img)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	w, h := p.Int("width", 0), p.Int("height", 0)
+	mode := p.String("mode", "fit")
+	filter := p.String("filter", "catmullrom")
+	if w <= 0 && h <= 0 {
+		return nil, fmt.Errorf("width or height required")
+	}
+	if sw == 0 || sh == 0 {
+		return src, nil
+	}
+	if w > maxImageSide || h > maxImageSide {
+		return nil, fmt.Errorf("width and height must be at most %d", maxImageSide)
+	}
+
+	tw, th := w, h
+	switch {
+	case w <= 0:
+		tw = max(1, int(math.Round(float64(sw)*float64(h)/float64(sh))))
+	case h <= 0:
+		th = max(1, int(math.Round(float64(sh)*float64(w)/float64(sw))))
+	case mode == "fit":
+		scale := math.Min(float64(w)/float64(sw), float64(h)/float64(sh))
+		tw = max(1, int(math.Round(float64(sw)*scale)))
+		th = max(1, int(math.Round(float64(sh)*scale)))
+	case mode == "fill":
+		scale := math.Max(float64(w)/float64(sw), float64(h)/float64(sh))
+		tw = max(w, int(math.Round(float64(sw)*scale)))
+		th = max(h, int(math.Round(float64(sh)*scale)))
+	case mode == "stretch":
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	// In fill mode tw x th is the enlarged image before the crop.
+	if err := checkResizeSize(tw, th, sh); err != nil {
+		return nil, err
+	}
+
+	var out *image.NRGBA
+	if filter == "nearest" {
+		out = resizeNearest(src, tw, th)
+	} else {
+		f, ok := resampleFilters[filter]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q", filter)
+		}
+		out = resizeFiltered(src, tw, th, f)
+	}
+	if mode == "fill" && w > 0 && h > 0 && (tw != w || th != h) {
+		return cropNRGBA(out, image.Rect((tw-w)/2, (th-h)/2, (tw-w)/2+w, (th-h)/2+h)), nil
+	}
+	return out, nil
+}
+
+func resizeNearest(src *image.NRGBA, w, h int) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			sy := (y*b.Dy() + b.Dy()/2) / h
+			for x := 0; x < w; x++ {
+				sx := (x*b.Dx() + b.Dx()/2) / w
+				si := sy*src.Stride + sx*4
+				di := y*dst.Stride + x*4
+				copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+			}
+		}
+	})
+	return dst
+}
+
+// resampleWeights holds, for every output index, the first contributing
+// input index and the normalised weights of the contributing inputs.
+type resampleWeights struct {
+	start   []int
+	weights [][]float64
+}
+
+func computeWeights(srcLen, dstLen int, f resampleFilter) resampleWeights {
+	scale := float64(srcLen) / float64(dstLen)
+	// Widen the kernel when shrinking so every source pixel contributes.
+	fscale := math.Max(scale, 1)
+	support := f.support * fscale
+	rw := resampleWeights{start: make([]int, dstLen), weights: make([][]float64, dstLen)}
+	for i := 0; i < dstLen; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		lo := max(0, int(math.Ceil(center-support)))
+		hi := min(srcLen-1, int(math.Floor(center+support)))
+		ws := make([]float64, 0, hi-lo+1)
+		sum := 0.0
+		for j := lo; j <= hi; j++ {
+			w := f.kernel((float64(j) - center) / fscale)
+			ws = append(ws, w)
+			sum += w
+		}
+		if sum != 0 {
+			for k := range ws {
+				ws[k] /= sum
+			}
+		}
+		rw.start[i] = lo
+		rw.weights[i] = ws
+	}
+	return rw
+}
+
+// resizeFiltered resamples horizontally then vertically. Colour channels are
+// weighted by alpha so transparent pixels do not bleed dark fringes.
+func resizeFiltered(src *image.NRGBA, w, h int, f resampleFilter) *image.NRGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	// Horizontal pass into a premultiplied float buffer of w x sh.
+	xw := computeWeights(sw, w, f)
+	tmp := make([]float64, w*sh*4)
+	parallelRows(sh, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := y * src.Stride
+			for x := 0; x < w; x++ {
+				var r, g, bl, a float64
+				for k, wt := range xw.weights[x] {
+					i := row + (xw.start[x]+k)*4
+					pa := float64(src.Pix[i+3]) * wt
+					r += float64(src.Pix[i+0]) * pa
+					g += float64(src.Pix[i+1]) * pa
+					bl += float64(src.Pix[i+2]) * pa
+					a += pa
+				}
+				t := (y*w + x) * 4
+				tmp[t+0], tmp[t+1], tmp[t+2], tmp[t+3] = r, g, bl, a
+			}
+		}
+	})
+
+	// Vertical pass and un-premultiply.
+	yw := computeWeights(sh, h, f)
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < w; x++ {
+				var r, g, bl, a float64
+				for k, wt := range yw.weights[y] {
+					t := ((yw.start[y]+k)*w + x) * 4
+					r += tmp[t+0] * wt
+					g += tmp[t+1] * wt
+					bl += tmp[t+2] * wt
+					a += tmp[t+3] * wt
+				}
+				i := y*dst.Stride + x*4
+				if a <= 0 {
+					continue
+				}
+				dst.Pix[i+0] = clamp8(r / a)
+				dst.Pix[i+1] = clamp8(g / a)
+				dst.Pix[i+2] = clamp8(bl / a)
+				dst.Pix[i+3] = clamp8(a)
+			}
+		}
+	})
+	return dst
+}
+
+// cropOp cuts out the rectangle x,y,width,height, clipped to the image.
+func cropOp(img image.Image, p Params) (image.Image, error) {
+	src := toNRGBA(img)
+	b := src.Bounds()
+	x, y := p.Int("x", 0), p.Int("y", 0)
+	r := image.Rect(x, y, x+p.Int("width", 0), y+p.Int("height", 0)).Add(b.Min).Intersect(b)
+	if r.Empty() {
+		return nil, fmt.Errorf("crop rectangle outside image %dx%d", b.Dx(), b.Dy())
+	}
+	return cropNRGBA(src, r.Sub(b.Min)), nil
+}
+
+// cropNRGBA copies r (relative to src's origin) into a new zero-based image.
+func cropNRGBA(src *image.NRGBA, r image.Rectangle) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		si := (r.Min.Y+y)*src.Stride + r.Min.X*4
+		copy(dst.Pix[y*dst.Stride:y*dst.Stride+r.Dx()*4], src.Pix[si:si+r.Dx()*4])
+	}
+	return dst
+}
+
+// flipOp mirrors the image; direction is horizontal (default) or vertical.
+func flipOp(img image.Image, p Params) (image.Image, error) {
+	src := toNRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	switch dir := p.String("direction", "horizontal"); dir {
+	case "horizontal":
+		parallelRows(h, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				for x := 0; x < w; x++ {
+					si := y*src.Stride + x*4
+					di := y*dst.Stride + (w-1-x)*4
+					copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+				}
+			}
+		})
+	case "vertical":
+		parallelRows(h, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				copy(dst.Pix[(h-1-y)*dst.Stride:(h-y)*dst.Stride], src.Pix[y*src.Stride:y*src.Stride+w*4])
+			}
+		})
+	default:
+		return nil, fmt.Errorf("unknown direction %q", dir)
+	}
+	return dst, nil
+}
+
+// rotateOp turns the image clockwise by angle degrees. Multiples of 90 are
+// exact; other angles are resampled bilinearly onto a canvas that fits the
+// rotated image, leaving the corners transparent.
+func rotateOp(img image.Image, p Params) (image.Image, error) {
+	src := toNRGBA(img)
+	angle := math.Mod(p.Float("angle", 0), 360)
+	if angle < 0 {
+		angle += 360
+	}
+	switch angle {
+	case 0:
+		return src, nil
+	case 90, 180, 270:
+		return rotateRight(src, int(angle)/90), nil
+	}
+	return rotateArbitrary(src, angle), nil
+}
+
+// rotateRight rotates by quarter turns clockwise.
+func rotateRight(src *image.NRGBA, turns int) *image.NRGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if turns%2 == 1 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < w; x++ {
+				var dx, dy int
+				switch turns {
+				case 1:
+					dx, dy = h-1-y, x
+				case 2:
+					dx, dy = w-1-x, h-1-y
+				case 3:
+					dx, dy = y, w-1-x
+				}
+				si := y*src.Stride + x*4
+				di := dy*dst.Stride + dx*4
+				copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+			}
+		}
+	})
+	return dst
+}
+
+func rotateArbitrary(src *image.NRGBA, deg float64) *image.NRGBA {
+	w, h := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	rad := deg * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	dw := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin)))
+	dh := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos)))
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	scx, scy := w/2, h/2
+	dcx, dcy := float64(dw)/2, float64(dh)/2
+	parallelRows(dh, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < dw; x++ {
+				// Inverse-map the destination pixel centre into the source.
+				fx, fy := float64(x)+0.5-dcx, float64(y)+0.5-dcy
+				sx := fx*cos + fy*sin + scx - 0.5
+				sy := -fx*sin + fy*cos + scy - 0.5
+				r, g, b, a := sampleBilinear(src, sx, sy)
+				i := y*dst.Stride + x*4
+				dst.Pix[i+0], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = r, g, b, a
+			}
+		}
+	})
+	return dst
+}
+
+// sampleBilinear reads src at a fractional position; samples outside the
+// image count as transparent.
+func sampleBilinear(src *image.NRGBA, x, y float64) (uint8, uint8, uint8, uint8) {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+	var r, g, b, a float64
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 2; i++ {
+			px, py := x0+i, y0+j
+			if px < 0 || py < 0 || px >= w || py >= h {
+				continue
+			}
+			wt := (1 - math.Abs(float64(i)-fx)) * (1 - math.Abs(float64(j)-fy))
+			k := py*src.Stride + px*4
+			pa := float64(src.Pix[k+3]) * wt
+			r += float64(src.Pix[k+0]) * pa
+			g += float64(src.Pix[k+1]) * pa
+			b += float64(src.Pix[k+2]) * pa
+			a += pa
+		}
+	}
+	if a <= 0 {
+		return 0, 0, 0, 0
+	}
+	return clamp8(r / a), clamp8(g / a), clamp8(b / a), clamp8(a)
+}
+
+func clamp8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}